@@ -2,29 +2,33 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/log"
-	"github.com/go-kit/kit/sd"
-	"github.com/go-kit/kit/sd/consul"
-	"github.com/go-kit/kit/sd/lb"
+	"go-kit-one/pkg/balancer"
+	"go-kit-one/pkg/registry"
+	"go-kit-one/pkg/retry"
+	"go-kit-one/pkg/tlsconfig"
 	"time"
 )
 
-func MakeDiscoverEndpoint(ctx context.Context, client consul.Client, logger log.Logger) endpoint.Endpoint {
+func MakeDiscoverEndpoint(ctx context.Context, reg registry.Registry, balancers *balancer.Group, retryPolicy retry.Policy, timeout time.Duration, certs *tlsconfig.Store, logger log.Logger) endpoint.Endpoint {
 	serviceName := "biz"
 	tags := []string{"biz", "vc"}
-	passingOnly := true
-	duration := 500 * time.Millisecond
 
-	instancer := consul.NewInstancer(client, logger, serviceName, tags, passingOnly)
+	instancer := registry.NewInstancer(reg, serviceName, tags, 10*time.Second, logger)
 
-	factory := BizFactory(ctx, "POST", "biz")
+	var tlsConfig *tls.Config
+	if certs != nil {
+		tlsConfig = certs.ClientConfig(serviceName)
+	}
+	factory := BizFactory(ctx, "POST", "biz", tlsConfig)
 
-	endpointer := sd.NewEndpointer(instancer, factory, logger)
+	logger.Log("service", serviceName, "balancer", balancers.Strategy(serviceName))
+	endpointBalancer := balancer.NewEndpointBalancer(instancer, factory, balancers.Get(serviceName), logger)
 
-	balancer := lb.NewRoundRobin(endpointer)
+	retryPolicy.Latency = retry.NewLatencyTracker()
 
-	retry := lb.Retry(1, duration, balancer)
-
-	return retry
+	// biz calls are POSTs that mustn't run twice
+	return retry.Endpoint(retryPolicy.NonIdempotent(), endpointBalancer, timeout)
 }
@@ -2,23 +2,39 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/sd"
 	kitHttp "github.com/go-kit/kit/transport/http"
+	"go-kit-one/pkg/balancer"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 )
 
-func BizFactory(ctx context.Context, method, path string) sd.Factory {
+// BizFactory calls instances over https with tlsConfig when it's set.
+func BizFactory(ctx context.Context, method, path string, tlsConfig *tls.Config) sd.Factory {
+	scheme := "http://"
+	var options []kitHttp.ClientOption
+	if tlsConfig != nil {
+		scheme = "https://"
+		// one client for all instances, so their connections are kept alive
+		client := &http.Client{Transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			TLSClientConfig:   tlsConfig,
+			ForceAttemptHTTP2: true,
+		}}
+		options = append(options, kitHttp.SetClient(client))
+	}
 	return func(instance string) (endpoint endpoint.Endpoint, closer io.Closer, err error) {
 		if !strings.HasPrefix(instance, "http") {
-			instance = "http://" + instance
+			instance = scheme + instance
 		}
 		tgt, err := url.Parse(instance)
 		if err != nil {
@@ -31,7 +47,7 @@ func BizFactory(ctx context.Context, method, path string) sd.Factory {
 		)
 		enc, dec = encodeBizRequest, decodeVizResponse
 
-		return kitHttp.NewClient(method, tgt, enc, dec).Endpoint(), nil, nil
+		return kitHttp.NewClient(method, tgt, enc, dec, options...).Endpoint(), nil, nil
 	}
 }
 
@@ -43,15 +59,17 @@ func encodeBizRequest(ctx context.Context, r *http.Request, request interface{})
 	return nil
 }
 
+// errorBodyLimit bounds the error bodies read into the error message.
+const errorBodyLimit = 4 << 10
+
 func decodeVizResponse(ctx context.Context, resp *http.Response) (interface{}, error) {
 	response := &BizResponse{}
-	var s map[string]interface{}
 
+	// the service encodes errors as text, the status decides how the
+	// failure counts and the body is only the message
 	if respCode := resp.StatusCode; respCode >= 400 {
-		if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
-			return nil, err
-		}
-		return nil, errors.New(s["error"].(string) + "\n")
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, errorBodyLimit))
+		return nil, balancer.StatusError{Code: respCode, Err: errors.New(errorMessage(resp.Status, body))}
 	}
 
 	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
@@ -60,3 +78,18 @@ func decodeVizResponse(ctx context.Context, resp *http.Response) (interface{}, e
 
 	return response, nil
 }
+
+// errorMessage is the "error" field of a JSON error body, the text of any
+// other body, or the status without one.
+func errorMessage(status string, body []byte) string {
+	var s struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &s) == nil && s.Error != "" {
+		return s.Error
+	}
+	if text := strings.TrimSpace(string(body)); text != "" {
+		return text
+	}
+	return status
+}
@@ -5,17 +5,43 @@ import (
 	"flag"
 	"fmt"
 	"github.com/go-kit/kit/log"
-	"github.com/go-kit/kit/sd/consul"
-	"github.com/hashicorp/consul/api"
+	kitPrometheus "github.com/go-kit/kit/metrics/prometheus"
+	stdPrometheus "github.com/prometheus/client_golang/prometheus"
+	"go-kit-one/pkg/balancer"
+	"go-kit-one/pkg/registry"
+	"go-kit-one/pkg/retry"
+	"go-kit-one/pkg/tlsconfig"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 var (
-	consulHost = flag.String("consul.host", "localhost", "consul server ip address")
-	consulPort = flag.String("consul.port", "8500", "consul server port")
+	consulHost  = flag.String("consul.host", "localhost", "consul server ip address")
+	consulPort  = flag.String("consul.port", "8500", "consul server port")
+	registryUrl = flag.String("registry", "", "registry url: consul://, etcd://, file://, dns:// or memory://, defaults to the consul flags")
+	lbStrategy  = flag.String("lb", "round_robin", "load balancing per upstream, e.g. p2c,biz=hash: round_robin, random, weighted, least_request, p2c or hash")
+	lbKey       = flag.String("lb.key", "", "hash balancer key: header:<name>, cookie:<name>, claim:<name> or path:<index>")
+	zone        = flag.String("zone", "", "local zone, instances with the same zone metadata are preferred")
+
+	outlierConsecutive = flag.Int("outlier.consecutive", 5, "consecutive 5xx or timeouts that eject an instance, 0 disables outlier detection")
+	outlierEjection    = flag.Duration("outlier.ejection", 30*time.Second, "base ejection time, doubled on every repeated ejection")
+	outlierMaxEjection = flag.Duration("outlier.max.ejection", 5*time.Minute, "upper bound of the ejection time")
+	outlierMaxPercent  = flag.Int("outlier.max.percent", 50, "max percentage of a service's instances ejected at once")
+
+	retryAttempts   = flag.Int("retry.attempts", 2, "attempts per call including the first; biz calls aren't idempotent, so they're only retried when no connection was made")
+	retryBackoff    = flag.Duration("retry.backoff", 20*time.Millisecond, "base retry backoff, doubled per retry with full jitter")
+	retryMaxBackoff = flag.Duration("retry.max.backoff", 200*time.Millisecond, "upper bound of the retry backoff")
+	retryBudget     = flag.Float64("retry.budget", 0.2, "retries and hedges allowed as a fraction of requests over 10s")
+	retryBudgetMin  = flag.Int("retry.budget.min", 10, "retries per second always allowed by the budget")
+	retryTimeout    = flag.Duration("retry.timeout", 500*time.Millisecond, "overall timeout of a call, retries and hedges included")
+	hedgePercentile = flag.Float64("hedge.percentile", 0, "latency percentile after which a hedged request goes to another instance, e.g. 0.95, 0 disables; biz calls aren't hedged")
+
+	upstreamTLSCert = flag.String("upstream.tls.cert", "", "client certificate presented to biz instances; reloaded when it changes")
+	upstreamTLSKey  = flag.String("upstream.tls.key", "", "private key file of upstream.tls.cert")
+	upstreamTLSCA   = flag.String("upstream.tls.ca", "", "ca bundle verifying biz certificates, which must name the service; calls biz over https when set")
 )
 
 func main() {
@@ -28,25 +54,71 @@ func main() {
 		logger = log.With(logger, "caller", log.DefaultCaller)
 	}
 
-	var client consul.Client
+	var reg registry.Registry
 	{
-		consulCfg := api.DefaultConfig()
-		consulCfg.Address = "http://" + *consulHost + ":" + *consulPort
-		consulClient, err := api.NewClient(consulCfg)
+		if *registryUrl == "" {
+			*registryUrl = "consul://" + *consulHost + ":" + *consulPort
+		}
+		var err error
+		reg, err = registry.New(*registryUrl)
 
 		if err != nil {
 			logger.Log("err", err)
 			os.Exit(1)
 		}
+	}
+
+	balancers, err := balancer.NewGroup(*lbStrategy, *zone, balancer.OutlierConfig{
+		Consecutive:       *outlierConsecutive,
+		BaseEjection:      *outlierEjection,
+		MaxEjection:       *outlierMaxEjection,
+		MaxEjectedPercent: *outlierMaxPercent,
+		Logger:            logger,
+		Ejections: kitPrometheus.NewCounterFrom(stdPrometheus.CounterOpts{
+			Namespace: "vince_cfl",
+			Subsystem: "discover",
+			Name:      "outlier_ejections",
+			Help:      "numbers of upstream instances ejected by outlier detection",
+		}, []string{"service", "instance"}),
+		Ejected: kitPrometheus.NewGaugeFrom(stdPrometheus.GaugeOpts{
+			Namespace: "vince_cfl",
+			Subsystem: "discover",
+			Name:      "outlier_ejected",
+			Help:      "upstream instances currently ejected by outlier detection",
+		}, []string{"service"}),
+	})
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+	hashKey, err := balancer.ParseKeySource(*lbKey)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+
+	retryPolicy := retry.Policy{
+		Attempts:        *retryAttempts,
+		BaseBackoff:     *retryBackoff,
+		MaxBackoff:      *retryMaxBackoff,
+		Budget:          retry.NewBudget(*retryBudget, *retryBudgetMin, 10*time.Second),
+		HedgePercentile: *hedgePercentile,
+	}
 
-		client = consul.NewClient(consulClient)
+	var certs *tlsconfig.Store
+	if files := (tlsconfig.Files{Cert: *upstreamTLSCert, Key: *upstreamTLSKey, CA: *upstreamTLSCA}); files.Enabled() {
+		certs, err = tlsconfig.New(files, logger)
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
 	}
 
 	ctx := context.Background()
 
-	discoverEndpoint := MakeDiscoverEndpoint(ctx, client, logger)
+	discoverEndpoint := MakeDiscoverEndpoint(ctx, reg, balancers, retryPolicy, *retryTimeout, certs, logger)
 
-	r := MakeHttpHandler(discoverEndpoint, logger)
+	r := MakeHttpHandler(discoverEndpoint, hashKey, logger)
 
 	errChan := make(chan error)
 	go func() {
@@ -8,6 +8,8 @@ import (
 	"github.com/go-kit/kit/log"
 	kitHttp "github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go-kit-one/pkg/balancer"
 	"net/http"
 )
 
@@ -22,12 +24,15 @@ type BizResponse struct {
 	Error  error `json:"error"`
 }
 
-func MakeHttpHandler(endpoint endpoint.Endpoint, logger log.Logger) http.Handler {
+func MakeHttpHandler(endpoint endpoint.Endpoint, hashKey balancer.KeySource, logger log.Logger) http.Handler {
 	r := mux.NewRouter()
 
 	options := []kitHttp.ServerOption{
 		kitHttp.ServerErrorLogger(logger),
 		kitHttp.ServerErrorEncoder(kitHttp.DefaultErrorEncoder),
+		kitHttp.ServerBefore(func(ctx context.Context, r *http.Request) context.Context {
+			return balancer.WithKey(ctx, hashKey.Key(r))
+		}),
 	}
 
 	r.Methods("POST").Path("/biz").Handler(kitHttp.NewServer(
@@ -37,6 +42,8 @@ func MakeHttpHandler(endpoint endpoint.Endpoint, logger log.Logger) http.Handler
 		options...
 	))
 
+	r.Path("/metrics").Handler(promhttp.Handler())
+
 	return r
 }
 
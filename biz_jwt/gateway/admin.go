@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+	"go-kit-one/pkg/registry"
+	"golang.org/x/time/rate"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var ErrAdminUnauthorized = errors.New("admin credentials required")
+
+// Admin exposes the runtime state of the gateway to operators and lets them
+// override circuits, drain instances and reload the routes. It's served on
+// its own listener behind basic auth.
+type Admin struct {
+	router   *HystrixRouter
+	cache    *registry.Cache
+	limiter  *rate.Limiter
+	reload   func() error
+	user     string
+	password string
+	logger   log.Logger
+}
+
+type instancesEntry struct {
+	registry.CacheEntry
+	Drained []string             `json:"drained,omitempty"`
+	Ejected map[string]time.Time `json:"ejected,omitempty"`
+}
+
+func NewAdmin(router *HystrixRouter, cache *registry.Cache, limiter *rate.Limiter, reload func() error, user, password string, logger log.Logger) *Admin {
+	return &Admin{
+		router:   router,
+		cache:    cache,
+		limiter:  limiter,
+		reload:   reload,
+		user:     user,
+		password: password,
+		logger:   logger,
+	}
+}
+
+func (a *Admin) Handler() http.Handler {
+	r := mux.NewRouter()
+	r.Use(a.authenticate)
+
+	r.Methods("GET").Path("/routes").HandlerFunc(a.routes)
+	r.Methods("GET").Path("/instances").HandlerFunc(a.instances)
+	r.Methods("POST").Path("/instances/{service}/{id}/drain").HandlerFunc(a.drain)
+	r.Methods("DELETE").Path("/instances/{service}/{id}/drain").HandlerFunc(a.undrain)
+	r.Methods("GET").Path("/circuits").HandlerFunc(a.circuits)
+	r.Methods("POST").Path("/circuits/{route}/{service}/{action:open|close|reset}").HandlerFunc(a.overrideCircuit)
+	r.Methods("GET").Path("/mirror/diffs").HandlerFunc(a.mirrorDiffs)
+	r.Methods("POST").Path("/cache/purge").HandlerFunc(a.purgeCache)
+	r.Methods("GET").Path("/streams").HandlerFunc(a.streams)
+	r.Methods("GET").Path("/limiter").HandlerFunc(a.limiterState)
+	r.Methods("POST").Path("/reload").HandlerFunc(a.reloadRoutes)
+
+	return r
+}
+
+func (a *Admin) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(a.user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(a.password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gateway admin"`)
+			writeError(w, http.StatusUnauthorized, ErrAdminUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *Admin) routes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.router.Routes())
+}
+
+func (a *Admin) instances(w http.ResponseWriter, r *http.Request) {
+	drained := make(map[string][]string)
+	for _, key := range a.router.Drained() {
+		service, id := splitDrained(key)
+		drained[service] = append(drained[service], id)
+	}
+
+	var entries []instancesEntry
+	for _, entry := range a.cache.Entries() {
+		e := instancesEntry{CacheEntry: entry, Drained: drained[entry.Service]}
+		if detector := a.router.balancers.Detector(entry.Service); detector != nil {
+			e.Ejected = detector.Ejected()
+		}
+		entries = append(entries, e)
+	}
+	writeJSON(w, entries)
+}
+
+func (a *Admin) drain(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := a.router.Drain(vars["service"], vars["id"]); err == ErrUnknownInstance {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) undrain(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := a.router.Undrain(vars["service"], vars["id"]); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) circuits(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.router.Circuits())
+}
+
+func (a *Admin) overrideCircuit(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	override := map[string]string{"open": CircuitForcedOpen, "close": CircuitForcedClosed, "reset": ""}[vars["action"]]
+	if err := a.router.OverrideCircuit(vars["route"]+"/"+vars["service"], override); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) mirrorDiffs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.router.mirrorer.Diffs())
+}
+
+func (a *Admin) purgeCache(w http.ResponseWriter, r *http.Request) {
+	a.router.cache.Purge()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) streams(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.router.StreamConnections())
+}
+
+func (a *Admin) limiterState(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, limiterState(a.limiter))
+}
+
+func (a *Admin) reloadRoutes(w http.ResponseWriter, r *http.Request) {
+	if err := a.reload(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, a.router.Routes())
+}
+
+func splitDrained(key string) (service, id string) {
+	if i := strings.Index(key, "/"); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return key, ""
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"go-kit-one/pkg/accesslog"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrMissingToken = errors.New("missing bearer token")
+)
+
+// authorize checks the bearer token of routes that require auth with the
+// secret the services sign tokens with, and returns its claims.
+func (router *HystrixRouter) authorize(r *http.Request) (jwt.MapClaims, error) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return nil, ErrMissingToken
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(auth[7:], claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return router.jwtSecret, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if name, ok := claims["name"].(string); ok {
+		accesslog.SetUser(r.Context(), name)
+	}
+	return claims, nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/go-kit/kit/metrics"
+	"go-kit-one/pkg/accesslog"
+	"go-kit-one/pkg/route"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheEntryOverhead approximates the memory of an entry besides its body.
+const cacheEntryOverhead = 512
+
+// ResponseCache is an in-memory LRU of upstream responses shared by all
+// cached routes, bounded by the bytes of the responses it holds. Concurrent
+// misses on the same key are coalesced into one upstream request. Requests
+// are counted per route as hit, miss, coalesced or bypass.
+type ResponseCache struct {
+	maxBytes int64
+	maxEntry int
+	requests metrics.Counter
+	size     metrics.Gauge
+
+	mtx     sync.Mutex
+	bytes   int64
+	lru     *list.List
+	entries map[string]*list.Element
+	flights map[string]chan struct{}
+}
+
+type cacheEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	vary    map[string]string
+	stored  time.Time
+	expires time.Time
+}
+
+func (e *cacheEntry) cost() int64 {
+	return int64(len(e.body) + len(e.key) + cacheEntryOverhead)
+}
+
+func NewResponseCache(maxBytes int64, maxEntry int, requests metrics.Counter, size metrics.Gauge) *ResponseCache {
+	return &ResponseCache{
+		maxBytes: maxBytes,
+		maxEntry: maxEntry,
+		requests: requests,
+		size:     size,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		flights:  make(map[string]chan struct{}),
+	}
+}
+
+// Serve answers r from the cache when its route is cached, and calls next
+// to fetch and maybe store the response otherwise. next reports whether the
+// response it wrote is complete, incomplete ones aren't stored.
+func (c *ResponseCache) Serve(w http.ResponseWriter, r *http.Request, match route.Match, next func(http.ResponseWriter) bool) {
+	policy := match.Route.Cache
+	if policy == nil || !policy.Cacheable(r.Method) {
+		next(w)
+		return
+	}
+	reqCC := parseCacheControl(r.Header.Get("Cache-Control"))
+	if _, ok := reqCC["no-store"]; ok {
+		c.count(match, "bypass")
+		next(w)
+		return
+	}
+	key, ok := c.key(r, match)
+	if !ok {
+		c.count(match, "bypass")
+		next(w)
+		return
+	}
+	// no-cache and max-age=0 revalidate, i.e. refetch, but still store
+	_, revalidate := reqCC["no-cache"]
+	if reqCC["max-age"] == "0" {
+		revalidate = true
+	}
+
+	var done chan struct{}
+	if !revalidate {
+		if entry := c.get(key, r); entry != nil {
+			c.count(match, "hit")
+			c.write(w, r, entry)
+			return
+		}
+		c.mtx.Lock()
+		flight, waiting := c.flights[key]
+		if !waiting {
+			done = make(chan struct{})
+			c.flights[key] = done
+		}
+		c.mtx.Unlock()
+
+		if waiting {
+			select {
+			case <-flight:
+			case <-r.Context().Done():
+			}
+			if entry := c.get(key, r); entry != nil {
+				c.count(match, "coalesced")
+				c.write(w, r, entry)
+				return
+			}
+		} else {
+			defer func() {
+				c.mtx.Lock()
+				delete(c.flights, key)
+				c.mtx.Unlock()
+				close(done)
+			}()
+		}
+	}
+
+	c.count(match, "miss")
+	w.Header().Set("X-Cache", "MISS")
+	cw := &captureWriter{ResponseWriter: w, limit: c.maxEntry}
+	if !next(cw) {
+		return
+	}
+	status, body, truncated := cw.snapshot()
+	if truncated {
+		return
+	}
+	if ttl, ok := cacheTTL(policy, w.Header(), r.Header.Get("Authorization") != ""); ok && status == http.StatusOK {
+		c.put(key, r, w.Header(), status, body, ttl)
+	}
+}
+
+// key identifies the response by route, method and URI, plus the body for
+// methods other than GET and HEAD. Bodies too large to cache bypass it.
+func (c *ResponseCache) key(r *http.Request, match route.Match) (string, bool) {
+	key := match.Route.Name + " " + r.Method + " " + r.Host + r.URL.RequestURI()
+	if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Body == nil || r.Body == http.NoBody {
+		return key, true
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(c.maxEntry)+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if err != nil || len(body) > c.maxEntry {
+		return "", false
+	}
+	sum := sha256.Sum256(body)
+	return key + " " + hex.EncodeToString(sum[:]), true
+}
+
+func (c *ResponseCache) get(key string, r *http.Request) *cacheEntry {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(el)
+		return nil
+	}
+	for name, value := range entry.vary {
+		if r.Header.Get(name) != value {
+			return nil
+		}
+	}
+	c.lru.MoveToFront(el)
+	return entry
+}
+
+func (c *ResponseCache) put(key string, r *http.Request, header http.Header, status int, body []byte, ttl time.Duration) {
+	header = header.Clone()
+	for _, name := range []string{"Set-Cookie", accesslog.RequestIDHeader, "X-Cache", "Connection", "Date"} {
+		header.Del(name)
+	}
+	entry := &cacheEntry{
+		key:     key,
+		status:  status,
+		header:  header,
+		body:    body,
+		stored:  time.Now(),
+		expires: time.Now().Add(ttl),
+	}
+	// a single variant is kept per key, the one of the last request
+	for _, name := range strings.Split(header.Get("Vary"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			if entry.vary == nil {
+				entry.vary = make(map[string]string)
+			}
+			entry.vary[name] = r.Header.Get(name)
+		}
+	}
+	if entry.cost() > c.maxBytes {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.bytes += entry.cost()
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+	c.size.Set(float64(c.bytes))
+}
+
+// remove must be called with mtx held.
+func (c *ResponseCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.cost()
+	c.size.Set(float64(c.bytes))
+}
+
+// Purge drops every cached response.
+func (c *ResponseCache) Purge() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+	c.bytes = 0
+	c.size.Set(0)
+}
+
+func (c *ResponseCache) write(w http.ResponseWriter, r *http.Request, entry *cacheEntry) {
+	accesslog.SetUpstream(r.Context(), "cache")
+	for name, values := range entry.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("X-Cache", "HIT")
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.stored).Seconds())))
+	w.WriteHeader(entry.status)
+	if r.Method != http.MethodHead {
+		w.Write(entry.body)
+	}
+}
+
+func (c *ResponseCache) count(match route.Match, result string) {
+	c.requests.With("route", match.Route.Name, "result", result).Add(1)
+}
+
+// cacheTTL decides from the upstream Cache-Control whether and how long a
+// response may be kept.
+func cacheTTL(policy *route.Cache, header http.Header, authorized bool) (time.Duration, bool) {
+	if header.Get("Vary") == "*" {
+		return 0, false
+	}
+	cc := parseCacheControl(header.Get("Cache-Control"))
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[directive]; ok {
+			return 0, false
+		}
+	}
+	_, public := cc["public"]
+	sMaxAge, shared := cc["s-maxage"]
+	if authorized && !policy.Auth && !public && !shared {
+		return 0, false
+	}
+
+	ttl := policy.TTLDuration()
+	if maxAge, ok := cc["max-age"]; ok {
+		if secs, err := strconv.Atoi(maxAge); err == nil {
+			ttl = time.Duration(secs) * time.Second
+		}
+	}
+	if shared {
+		if secs, err := strconv.Atoi(sMaxAge); err == nil {
+			ttl = time.Duration(secs) * time.Second
+		}
+	}
+	return ttl, ttl > 0
+}
+
+func parseCacheControl(s string) map[string]string {
+	cc := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value := part, ""
+		if i := strings.Index(part, "="); i >= 0 {
+			name, value = part[:i], strings.Trim(part[i+1:], `"`)
+		}
+		cc[strings.ToLower(name)] = value
+	}
+	return cc
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"go-kit-one/pkg/balancer"
+	"go-kit-one/pkg/route"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// composeMaxBody bounds a part's response, parts answer small documents.
+const composeMaxBody = 1 << 20
+
+var ErrComposeParts = errors.New("compose parts failed")
+
+type partResult struct {
+	value    interface{}
+	err      error
+	fallback bool
+	rejected *partRejection
+}
+
+// partRejection is a part's 4xx response. The client caused it, so it
+// doesn't count against the part's circuit and is passed to the client.
+type partRejection struct {
+	code        int
+	contentType string
+	body        []byte
+}
+
+func (e *partRejection) Error() string {
+	return http.StatusText(e.code)
+}
+
+// compose answers a composition route: every part is called in parallel
+// under its own hystrix command, named route/part, and the responses are
+// merged by the route's template. Parts answered by their fallback are
+// listed in the X-Compose-Fallback header. A part rejecting the request
+// with a 4xx answers it with that response.
+func (router *HystrixRouter) compose(w http.ResponseWriter, r *http.Request, match route.Match) {
+	parts := match.Route.Compose.Parts
+	results := make([]partResult, len(parts))
+
+	var wg sync.WaitGroup
+	for i, part := range parts {
+		wg.Add(1)
+		go func(i int, part *route.Part) {
+			defer wg.Done()
+			results[i] = router.composePart(r, match, part, match.PartPaths[i])
+		}(i, part)
+	}
+	wg.Wait()
+
+	for _, res := range results {
+		if res.rejected != nil {
+			if res.rejected.contentType != "" {
+				w.Header().Set("Content-Type", res.rejected.contentType)
+			}
+			w.WriteHeader(res.rejected.code)
+			w.Write(res.rejected.body)
+			return
+		}
+	}
+
+	values := make(map[string]interface{}, len(parts))
+	var failed, fallbacks []string
+	for i, part := range parts {
+		if results[i].err != nil {
+			failed = append(failed, part.Name)
+			continue
+		}
+		if results[i].fallback {
+			fallbacks = append(fallbacks, part.Name)
+		}
+		values[part.Name] = results[i].value
+	}
+	if len(failed) > 0 {
+		writeComposeError(w, ErrComposeParts, failed)
+		return
+	}
+
+	doc, err := match.Route.Compose.Render(values)
+	if err != nil {
+		router.logger.Log("route", match.Route.Name, "compose", err.Error())
+		writeComposeError(w, err, nil)
+		return
+	}
+	if len(fallbacks) > 0 {
+		w.Header().Set("X-Compose-Fallback", strings.Join(fallbacks, ","))
+	}
+	writeJSON(w, doc)
+}
+
+func (router *HystrixRouter) composePart(r *http.Request, match route.Match, part *route.Part, path string) partResult {
+	command := match.Route.Name + "/" + part.Name
+	router.configure(command, part.TimeoutDuration())
+
+	ctx, cancel := context.WithTimeout(r.Context(), part.TimeoutDuration())
+	defer cancel()
+
+	// hystrix may give up on run and call the fallback while run is still
+	// going, the first of them to finish decides the result
+	var (
+		mtx    sync.Mutex
+		result partResult
+		set    bool
+	)
+	finish := func(res partResult) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if !set {
+			result, set = res, true
+		}
+	}
+
+	run := func(ctx context.Context) error {
+		value, err := router.callPart(ctx, r, match, part, path)
+		var rejected *partRejection
+		if errors.As(err, &rejected) {
+			finish(partResult{rejected: rejected})
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		finish(partResult{value: value})
+		return nil
+	}
+	fallback := func(err error) error {
+		router.logger.Log("route", match.Route.Name, "part", part.Name, "fallback error desc", err.Error())
+		if value, ok := part.FallbackValue(); ok {
+			finish(partResult{value: value, fallback: true})
+			return nil
+		}
+		if part.Optional {
+			finish(partResult{fallback: true})
+			return nil
+		}
+		return err
+	}
+
+	if err := router.do(ctx, command, part.TimeoutDuration(), run, fallback); err != nil {
+		finish(partResult{err: err})
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	return result
+}
+
+// callPart goes through the part's service proxy transport, so parts are
+// balanced, retried and hedged like proxied requests, and through the
+// route's plugins.
+func (router *HystrixRouter) callPart(ctx context.Context, r *http.Request, match route.Match, part *route.Part, path string) (interface{}, error) {
+	instances, err := router.registry.Instances(part.Service)
+	if err != nil {
+		return nil, err
+	}
+	instances = router.undrained(part.Service, instances)
+	if len(instances) == 0 {
+		return nil, balancer.ErrNoInstances
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	call := &proxyCall{instances: instances, path: path, plugins: match.Route.PluginChain()}
+	ctx = context.WithValue(balancer.WithKey(ctx, router.hashKey.Key(r)), proxyCallKey{}, call)
+	out, err := http.NewRequestWithContext(ctx, part.Method, router.transports.Scheme()+"://"+part.Service+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	out.URL.RawQuery = r.URL.RawQuery
+	out.Header = r.Header.Clone()
+	// the response is decoded here, so let the transport negotiate gzip
+	out.Header.Del("Accept-Encoding")
+	out.Header.Del("Content-Length")
+	out.Header.Del("Connection")
+	if err := call.plugins.Before(out); err != nil {
+		return nil, err
+	}
+
+	resp, err := router.proxy(part.Service).Transport.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := call.plugins.After(resp); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 500 {
+		return nil, balancer.StatusError{Code: resp.StatusCode, Err: errors.New(resp.Status)}
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, composeMaxBody))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return nil, &partRejection{code: resp.StatusCode, contentType: resp.Header.Get("Content-Type"), body: body}
+	}
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func writeComposeError(w http.ResponseWriter, err error, parts []string) {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusBadGateway)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error(), "parts": parts})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"github.com/afex/hystrix-go/hystrix"
+	"go-kit-one/pkg/registry"
+	"sort"
+)
+
+const (
+	CircuitForcedOpen   = "open"
+	CircuitForcedClosed = "closed"
+)
+
+var (
+	ErrCircuitForcedOpen = errors.New("circuit forced open")
+	ErrUnknownOverride   = errors.New("circuit override is open, closed or empty to clear it")
+	ErrUnknownInstance   = errors.New("no such service instance id")
+	ErrNotDrained        = errors.New("instance is not drained")
+)
+
+// Drain stops sending new requests to an instance until Undrain, while
+// requests in flight complete. The instance has to be registered.
+func (router *HystrixRouter) Drain(serviceName, id string) error {
+	instances, err := router.registry.Instances(serviceName)
+	if err != nil {
+		return err
+	}
+	for _, inst := range instances {
+		if inst.ID == id {
+			router.drained.Store(serviceName+"/"+id, struct{}{})
+			router.logger.Log("service", serviceName, "instance", id, "drain", true)
+			return nil
+		}
+	}
+	return ErrUnknownInstance
+}
+
+// Undrain works for instances that have deregistered meanwhile, so their
+// drains can be cleaned up.
+func (router *HystrixRouter) Undrain(serviceName, id string) error {
+	if _, ok := router.drained.LoadAndDelete(serviceName + "/" + id); !ok {
+		return ErrNotDrained
+	}
+	router.logger.Log("service", serviceName, "instance", id, "drain", false)
+	return nil
+}
+
+// Drained lists drained instances as service/id.
+func (router *HystrixRouter) Drained() []string {
+	var drained []string
+	router.drained.Range(func(key, _ interface{}) bool {
+		drained = append(drained, key.(string))
+		return true
+	})
+	sort.Strings(drained)
+	return drained
+}
+
+func (router *HystrixRouter) undrained(serviceName string, instances []registry.Instance) []registry.Instance {
+	res := instances[:0:0]
+	for _, inst := range instances {
+		if _, ok := router.drained.Load(serviceName + "/" + inst.ID); !ok {
+			res = append(res, inst)
+		}
+	}
+	return res
+}
+
+// OverrideCircuit forces the circuit of a hystrix command open, so requests
+// go straight to the fallback, or closed, so they bypass hystrix. An empty
+// override hands the circuit back to hystrix.
+func (router *HystrixRouter) OverrideCircuit(command, override string) error {
+	switch override {
+	case CircuitForcedOpen, CircuitForcedClosed:
+		router.overrides.Store(command, override)
+	case "":
+		router.overrides.Delete(command)
+	default:
+		return ErrUnknownOverride
+	}
+	router.logger.Log("command", command, "circuit override", override)
+	return nil
+}
+
+func (router *HystrixRouter) CircuitOverride(command string) string {
+	if override, ok := router.overrides.Load(command); ok {
+		return override.(string)
+	}
+	return ""
+}
+
+type CircuitState struct {
+	Command   string `json:"command"`
+	TimeoutMs int    `json:"timeout_ms"`
+	Open      bool   `json:"open"`
+	Override  string `json:"override,omitempty"`
+}
+
+// Circuits reports every hystrix command the router has configured.
+func (router *HystrixRouter) Circuits() []CircuitState {
+	var states []CircuitState
+	router.svcMap.Range(func(key, value interface{}) bool {
+		command := key.(string)
+		state := CircuitState{
+			Command:   command,
+			TimeoutMs: value.(int),
+			Override:  router.CircuitOverride(command),
+		}
+		if circuit, _, err := hystrix.GetCircuit(command); err == nil {
+			state.Open = circuit.IsOpen()
+		}
+		states = append(states, state)
+		return true
+	})
+	sort.Slice(states, func(i, j int) bool { return states[i].Command < states[j].Command })
+	return states
+}
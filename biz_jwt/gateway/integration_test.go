@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/openzipkin/zipkin-go"
+	"github.com/openzipkin/zipkin-go/reporter"
+	"go-kit-one/pkg/balancer"
+	"go-kit-one/pkg/consulfake"
+	"go-kit-one/pkg/registry"
+	"go-kit-one/pkg/retry"
+	"go-kit-one/pkg/route"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestTopology runs two biz instances registering with consulfake and
+// calls biz/add through the gateway, before and after one of them shuts
+// down and deregisters.
+func TestTopology(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs the biz service")
+	}
+
+	fake, err := consulfake.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.Close()
+
+	bin := filepath.Join(t.TempDir(), "biz")
+	if out, err := exec.Command("go", "build", "-o", bin, "../register").CombinedOutput(); err != nil {
+		t.Fatalf("build biz service: %v\n%s", err, out)
+	}
+	first := startBiz(t, bin, fake.Addr())
+	second := startBiz(t, bin, fake.Addr())
+	defer second.Process.Kill()
+	defer first.Process.Kill()
+
+	reg, err := registry.New("consul://" + fake.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the poll interval is longer than the test waits, so instance
+	// changes can only arrive through blocking queries
+	instances := registry.NewCache(reg, time.Minute, discard.NewGauge(), log.NewNopLogger())
+	defer instances.Stop()
+	gateway := httptest.NewServer(newTestRouter(t, instances))
+	defer gateway.Close()
+
+	waitInstances(t, instances, 2)
+
+	token := login(t, gateway.URL)
+	for i := 0; i < 4; i++ {
+		if got := add(t, gateway.URL, token, i, 2); got != i+2 {
+			t.Fatalf("add %d 2: got %d", i, got)
+		}
+	}
+
+	if err := first.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	waitInstances(t, instances, 1)
+	first.Wait()
+
+	for i := 0; i < 4; i++ {
+		if got := add(t, gateway.URL, token, i, 3); got != i+3 {
+			t.Fatalf("add %d 3 after deregistration: got %d", i, got)
+		}
+	}
+}
+
+func newTestRouter(t testing.TB, reg registry.Registry) *HystrixRouter {
+	logger := log.NewNopLogger()
+	balancers, err := balancer.NewGroup("round_robin", "", balancer.OutlierConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer, err := zipkin.NewTracer(reporter.NewNoopReporter(), zipkin.WithNoopTracer(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transports := newTransportPool(TransportConfig{
+		MaxIdleConns:        16,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     time.Minute,
+		DialTimeout:         time.Second,
+	}, tracer)
+	versions := VersionMetrics{Requests: discard.NewCounter(), Latency: discard.NewHistogram()}
+	mirrorer := NewMirrorer(reg, balancers, transports, discard.NewCounter(), logger)
+	cache := NewResponseCache(1<<20, 1<<10, discard.NewCounter(), discard.NewGauge())
+	streams := StreamMetrics{Open: discard.NewGauge(), Closed: discard.NewCounter()}
+	return NewRoutes(reg, route.Default(), []byte("secret"), balancers, balancer.KeySource{}, retry.Policy{Attempts: 1},
+		transports, versions, mirrorer, cache, streams, "circuit breaker:service unavailable", logger)
+}
+
+func startBiz(t *testing.T, bin, consul string) *exec.Cmd {
+	port := freePort(t)
+	cmd := exec.Command(bin,
+		"-registry", "consul://"+consul,
+		"-service.host", "127.0.0.1",
+		"-service.port", port,
+		"-service.id", "biz-"+port,
+		"-consul.check", "ttl",
+		"-zipkin.url", "",
+		"-access.log", "",
+		"-audit.file", "",
+		"-shutdown.drain", "0s",
+	)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
+func waitInstances(t *testing.T, reg registry.Registry, want int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		instances, _ := reg.Instances("biz")
+		if len(instances) == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("biz instances: got %d, want %d", len(instances), want)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func login(t *testing.T, gateway string) string {
+	resp, err := http.Post(gateway+"/biz/login", "application/json", bytes.NewBufferString(`{"name":"admin","pwd":"admin"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Success bool   `json:"success"`
+		Token   string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil || !res.Success {
+		t.Fatalf("login: %d %v %+v", resp.StatusCode, err, res)
+	}
+	return res.Token
+}
+
+func add(t *testing.T, gateway, token string, a, b int) int {
+	req, _ := http.NewRequest("POST", fmt.Sprintf("%s/biz/biz/add/%d/%d", gateway, a, b), nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Result int `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("add %d %d: %d %v", a, b, resp.StatusCode, err)
+	}
+	return res.Result
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"golang.org/x/time/rate"
+	"net/http"
+)
+
+// LimiterState is the gateway limiter as shown by the admin API.
+type LimiterState struct {
+	Limit  float64 `json:"limit"`
+	Burst  int     `json:"burst"`
+	Tokens float64 `json:"tokens"`
+}
+
+// NewLimitMiddleware rejects requests with 429 once the gateway as a whole
+// goes over limiter's rate.
+func NewLimitMiddleware(limiter *rate.Limiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !limiter.Allow() {
+				w.WriteHeader(http.StatusTooManyRequests)
+				w.Write([]byte("rate limit exceeded"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func limiterState(limiter *rate.Limiter) LimiterState {
+	state := LimiterState{Limit: float64(limiter.Limit()), Burst: limiter.Burst(), Tokens: limiter.Tokens()}
+	if limiter.Limit() == rate.Inf {
+		// json can't encode +Inf, unlimited is reported as 0
+		state.Limit, state.Tokens = 0, 0
+	}
+	return state
+}
@@ -1,28 +1,84 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/afex/hystrix-go/hystrix"
 	"github.com/go-kit/kit/log"
-	"github.com/hashicorp/consul/api"
+	kitPrometheus "github.com/go-kit/kit/metrics/prometheus"
 	"github.com/openzipkin/zipkin-go"
 	zipkinHttpsvr "github.com/openzipkin/zipkin-go/middleware/http"
 	zipkinHttp "github.com/openzipkin/zipkin-go/reporter/http"
-	"math/rand"
+	stdPrometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go-kit-one/pkg/accesslog"
+	"go-kit-one/pkg/balancer"
+	"go-kit-one/pkg/registry"
+	"go-kit-one/pkg/retry"
+	"go-kit-one/pkg/route"
+	"go-kit-one/pkg/tlsconfig"
+	"golang.org/x/time/rate"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
+	"time"
 )
 
 var (
-	consulHost = flag.String("consul.host", "192.168.0.103", "consul server ip address")
-	consulPort = flag.String("consul.port", "8500", "consul server port")
-	zipkinUrl  = flag.String("zipkin.url", "http://192.168.0.103:9411/api/v2/spans", "zipkin server url")
+	consulHost      = flag.String("consul.host", "192.168.0.103", "consul server ip address")
+	consulPort      = flag.String("consul.port", "8500", "consul server port")
+	registryUrl     = flag.String("registry", "", "registry url: consul://, etcd://, file://, dns:// or memory://, defaults to the consul flags")
+	registryRefresh = flag.Duration("registry.refresh", 10*time.Second, "poll interval of instances for registries without blocking queries")
+	zipkinUrl       = flag.String("zipkin.url", "http://192.168.0.103:9411/api/v2/spans", "zipkin server url")
+	accessLog       = flag.String("access.log", "combined", "access log format: common, combined, extended, json or empty to disable")
+	lbStrategy      = flag.String("lb", "round_robin", "load balancing per upstream, e.g. p2c,biz=hash: round_robin, random, weighted, least_request, p2c or hash")
+	lbKey           = flag.String("lb.key", "", "hash balancer key: header:<name>, cookie:<name>, claim:<name> or path:<index>")
+	routesFile      = flag.String("routes", "", "json route table, reloaded on SIGHUP; empty routes by the first path segment")
+	jwtSecret       = flag.String("jwt.secret", "adcd1234!@#$", "secret of the tokens checked on routes requiring auth")
+	zone            = flag.String("zone", "", "local zone, instances with the same zone metadata are preferred")
+
+	outlierConsecutive = flag.Int("outlier.consecutive", 5, "consecutive 5xx or timeouts that eject an instance, 0 disables outlier detection")
+	outlierEjection    = flag.Duration("outlier.ejection", 30*time.Second, "base ejection time, doubled on every repeated ejection")
+	outlierMaxEjection = flag.Duration("outlier.max.ejection", 5*time.Minute, "upper bound of the ejection time")
+	outlierMaxPercent  = flag.Int("outlier.max.percent", 50, "max percentage of a service's instances ejected at once")
+
+	retryAttempts   = flag.Int("retry.attempts", 2, "attempts per request including the first, only idempotent requests are retried")
+	retryBackoff    = flag.Duration("retry.backoff", 20*time.Millisecond, "base retry backoff, doubled per retry with full jitter")
+	retryMaxBackoff = flag.Duration("retry.max.backoff", 200*time.Millisecond, "upper bound of the retry backoff")
+	retryBudget     = flag.Float64("retry.budget", 0.2, "retries and hedges allowed as a fraction of requests over 10s")
+	retryBudgetMin  = flag.Int("retry.budget.min", 10, "retries per second always allowed by the budget")
+	hedgePercentile = flag.Float64("hedge.percentile", 0, "latency percentile after which a hedged request goes to another instance, e.g. 0.95, 0 disables")
+
+	upstreamMaxIdle        = flag.Int("upstream.max.idle", 256, "idle keep-alive connections kept across all instances of an upstream")
+	upstreamMaxIdlePerHost = flag.Int("upstream.max.idle.per.host", 64, "idle keep-alive connections kept per upstream instance")
+	upstreamIdleTimeout    = flag.Duration("upstream.idle.timeout", 90*time.Second, "how long an idle upstream connection is kept")
+	upstreamDialTimeout    = flag.Duration("upstream.dial.timeout", 2*time.Second, "upstream connect timeout")
+	upstreamTLSTimeout     = flag.Duration("upstream.tls.timeout", 5*time.Second, "upstream TLS handshake timeout")
+	upstreamHTTP2          = flag.Bool("upstream.http2", true, "negotiate HTTP/2 with TLS upstreams")
+	upstreamTLSCert        = flag.String("upstream.tls.cert", "", "client certificate presented to upstreams; reloaded when it changes")
+	upstreamTLSKey         = flag.String("upstream.tls.key", "", "private key file of upstream.tls.cert")
+	upstreamTLSCA          = flag.String("upstream.tls.ca", "", "ca bundle verifying upstream certificates, which must name the service; calls upstreams over https when set")
+
+	rateLimit = flag.Float64("rate.limit", 0, "requests per second accepted by the gateway, 0 is unlimited")
+	rateBurst = flag.Int("rate.burst", 100, "requests accepted in a burst above rate.limit")
+
+	cacheSize     = flag.Int64("cache.size", 64<<20, "bytes of responses kept by the gateway cache")
+	cacheMaxEntry = flag.Int("cache.max.entry", 1<<20, "largest response body kept by the gateway cache")
+
+	adminAddr     = flag.String("admin.addr", ":8011", "admin api listen address")
+	adminUser     = flag.String("admin.user", "admin", "admin api basic auth user")
+	adminPassword = flag.String("admin.password", "", "admin api basic auth password, empty disables the admin api")
+
+	tlsCert   = flag.String("tls.cert", "", "certificate file, serves https on the gateway and admin listeners when set; reloaded when it changes")
+	tlsKey    = flag.String("tls.key", "", "private key file of tls.cert")
+	tlsCA     = flag.String("tls.ca", "", "ca bundle verifying client certificates")
+	tlsClient = flag.String("tls.client.auth", "none", "client certificates: none, optional (verified when sent) or require")
 )
 
 func main() {
@@ -60,63 +116,260 @@ func main() {
 		}
 	}
 
-	consulCfg := api.DefaultConfig()
-	consulCfg.Address = "http://" + *consulHost + ":" + *consulPort
-	consulClient, err := api.NewClient(consulCfg)
+	if *registryUrl == "" {
+		*registryUrl = "consul://" + *consulHost + ":" + *consulPort
+	}
+	reg, err := registry.New(*registryUrl)
 
 	if err != nil {
 		logger.Log("err", err)
 		os.Exit(1)
 	}
 
-	//proxy := NewReverseProxy(consulClient, zipKinTracer, logger)
-	hystrixRouter := NewRoutes(consulClient, zipKinTracer, "circuit breaker:service unavailable", logger)
+	// instances are watched per service instead of queried per request,
+	// and the last known instances keep being served while the registry is down
+	instanceCache := registry.NewCache(reg, *registryRefresh, kitPrometheus.NewGaugeFrom(stdPrometheus.GaugeOpts{
+		Namespace: "vince_cfl",
+		Subsystem: "gateway",
+		Name:      "instance_cache_age_seconds",
+		Help:      "age of the cached instances of a service, 0 while the registry answers",
+	}, []string{"service"}), logger)
+	defer instanceCache.Stop()
+
+	balancers, err := balancer.NewGroup(*lbStrategy, *zone, balancer.OutlierConfig{
+		Consecutive:       *outlierConsecutive,
+		BaseEjection:      *outlierEjection,
+		MaxEjection:       *outlierMaxEjection,
+		MaxEjectedPercent: *outlierMaxPercent,
+		Logger:            logger,
+		Ejections: kitPrometheus.NewCounterFrom(stdPrometheus.CounterOpts{
+			Namespace: "vince_cfl",
+			Subsystem: "gateway",
+			Name:      "outlier_ejections",
+			Help:      "numbers of upstream instances ejected by outlier detection",
+		}, []string{"service", "instance"}),
+		Ejected: kitPrometheus.NewGaugeFrom(stdPrometheus.GaugeOpts{
+			Namespace: "vince_cfl",
+			Subsystem: "gateway",
+			Name:      "outlier_ejected",
+			Help:      "upstream instances currently ejected by outlier detection",
+		}, []string{"service"}),
+	})
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+	hashKey, err := balancer.ParseKeySource(*lbKey)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+
+	retryPolicy := retry.Policy{
+		Attempts:        *retryAttempts,
+		BaseBackoff:     *retryBackoff,
+		MaxBackoff:      *retryMaxBackoff,
+		Budget:          retry.NewBudget(*retryBudget, *retryBudgetMin, 10*time.Second),
+		HedgePercentile: *hedgePercentile,
+	}
+
+	var upstreamTLS *tlsconfig.Store
+	if files := (tlsconfig.Files{Cert: *upstreamTLSCert, Key: *upstreamTLSKey, CA: *upstreamTLSCA}); files.Enabled() {
+		upstreamTLS, err = tlsconfig.New(files, logger)
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+	}
+
+	transports := newTransportPool(TransportConfig{
+		MaxIdleConns:        *upstreamMaxIdle,
+		MaxIdleConnsPerHost: *upstreamMaxIdlePerHost,
+		IdleConnTimeout:     *upstreamIdleTimeout,
+		DialTimeout:         *upstreamDialTimeout,
+		TLSHandshakeTimeout: *upstreamTLSTimeout,
+		HTTP2:               *upstreamHTTP2,
+		TLS:                 upstreamTLS,
+	}, zipKinTracer)
+
+	routes, err := loadRoutes(*routesFile)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+
+	versionLabels := []string{"route", "service", "version", "code"}
+	versionMetrics := VersionMetrics{
+		Requests: kitPrometheus.NewCounterFrom(stdPrometheus.CounterOpts{
+			Namespace: "vince_cfl",
+			Subsystem: "gateway",
+			Name:      "version_requests",
+			Help:      "numbers of requests of split routes per service version",
+		}, versionLabels),
+		Latency: kitPrometheus.NewSummaryFrom(stdPrometheus.SummaryOpts{
+			Namespace: "vince_cfl",
+			Subsystem: "gateway",
+			Name:      "version_request_latency",
+			Help:      "duration of requests of split routes per service version in seconds",
+		}, versionLabels),
+	}
+
+	mirrorer := NewMirrorer(instanceCache, balancers, transports, kitPrometheus.NewCounterFrom(stdPrometheus.CounterOpts{
+		Namespace: "vince_cfl",
+		Subsystem: "gateway",
+		Name:      "mirror_requests",
+		Help:      "numbers of mirrored requests per route and result: mirrored, match, mismatch, error, dropped, too_large or incomplete",
+	}, []string{"route", "result"}), logger)
+
+	responseCache := NewResponseCache(*cacheSize, *cacheMaxEntry, kitPrometheus.NewCounterFrom(stdPrometheus.CounterOpts{
+		Namespace: "vince_cfl",
+		Subsystem: "gateway",
+		Name:      "cache_requests",
+		Help:      "numbers of requests of cached routes per route and result: hit, miss, coalesced or bypass",
+	}, []string{"route", "result"}), kitPrometheus.NewGaugeFrom(stdPrometheus.GaugeOpts{
+		Namespace: "vince_cfl",
+		Subsystem: "gateway",
+		Name:      "cache_bytes",
+		Help:      "bytes of responses held by the gateway cache",
+	}, []string{}))
+
+	streamMetrics := StreamMetrics{
+		Open: kitPrometheus.NewGaugeFrom(stdPrometheus.GaugeOpts{
+			Namespace: "vince_cfl",
+			Subsystem: "gateway",
+			Name:      "stream_connections",
+			Help:      "open websocket and sse connections per route",
+		}, []string{"route", "kind"}),
+		Closed: kitPrometheus.NewCounterFrom(stdPrometheus.CounterOpts{
+			Namespace: "vince_cfl",
+			Subsystem: "gateway",
+			Name:      "stream_closed",
+			Help:      "numbers of closed websocket and sse connections per route and reason: done, error, idle, lifetime or limit",
+		}, []string{"route", "kind", "reason"}),
+	}
+
+	//proxy := NewReverseProxy(instanceCache, routes, balancers, hashKey, transports, logger)
+	hystrixRouter := NewRoutes(instanceCache, routes, []byte(*jwtSecret), balancers, hashKey, retryPolicy, transports, versionMetrics, mirrorer, responseCache, streamMetrics, "circuit breaker:service unavailable", logger)
 
 	tags := map[string]string{
 		"component": "gateway_server",
 	}
 
+	limit := rate.Inf
+	if *rateLimit > 0 {
+		limit = rate.Limit(*rateLimit)
+	}
+	limiter := rate.NewLimiter(limit, *rateBurst)
+
 	handler := zipkinHttpsvr.NewServerMiddleware(
 		zipKinTracer,
 		zipkinHttpsvr.SpanName("gateway"),
 		zipkinHttpsvr.TagResponseSize(true),
 		zipkinHttpsvr.ServerTags(tags),
-	)(hystrixRouter)
+	)(NewLimitMiddleware(limiter)(hystrixRouter))
+
+	if *accessLog != "" {
+		accessLogger, err := accesslog.NewLogger(os.Stdout, *accessLog)
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		handler = accesslog.Middleware(accessLogger)(handler)
+	}
+
+	var tlsConfig *tls.Config
+	if *tlsCert != "" {
+		certs, err := tlsconfig.New(tlsconfig.Files{Cert: *tlsCert, Key: *tlsKey, CA: *tlsCA}, logger)
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		tlsConfig, err = certs.ServerConfig(*tlsClient)
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+	}
 
 	errChan := make(chan error)
 
+	reloadRoutes := func() error {
+		routes, err := loadRoutes(*routesFile)
+		if err != nil {
+			logger.Log("routes", *routesFile, "reload", "failed", "err", err)
+			return err
+		}
+		hystrixRouter.SetRoutes(routes)
+		logger.Log("routes", *routesFile, "reload", "ok", "count", len(routes.Routes))
+		return nil
+	}
+
 	hystrixHandler := hystrix.NewStreamHandler()
 	hystrixHandler.Start()
+	monitorMux := http.NewServeMux()
+	monitorMux.Handle("/metrics", promhttp.Handler())
+	monitorMux.Handle("/", hystrixHandler)
 	go func() {
-		errChan <- http.ListenAndServe(net.JoinHostPort("", "8010"), hystrixHandler)
+		errChan <- http.ListenAndServe(net.JoinHostPort("", "8010"), monitorMux)
 	}()
 
 	go func() {
 		c := make(chan os.Signal)
-		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-		errChan <- fmt.Errorf("%s", <-c)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		for sig := range c {
+			if sig != syscall.SIGHUP {
+				errChan <- fmt.Errorf("%s", sig)
+				return
+			}
+			reloadRoutes()
+		}
 	}()
 
+	if *adminPassword != "" {
+		admin := NewAdmin(hystrixRouter, instanceCache, limiter, reloadRoutes, *adminUser, *adminPassword, logger)
+		go func() {
+			logger.Log("transport", "admin", "addr", *adminAddr)
+			errChan <- listenAndServe(*adminAddr, admin.Handler(), tlsConfig)
+		}()
+	}
+
 	go func() {
 		logger.Log("transport", "http", "addr", "8003")
-		errChan <- http.ListenAndServe(":8003", handler)
+		errChan <- listenAndServe(":8003", handler, tlsConfig)
 	}()
 
 	logger.Log("exit", <-errChan)
 }
 
-func NewReverseProxy(client *api.Client, tracer *zipkin.Tracer, logger log.Logger) *httputil.ReverseProxy {
+// listenAndServe serves https when tlsConfig is set.
+func listenAndServe(addr string, handler http.Handler, tlsConfig *tls.Config) error {
+	server := &http.Server{Addr: addr, Handler: handler, TLSConfig: tlsConfig}
+	if tlsConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+func loadRoutes(path string) (*route.Table, error) {
+	if path == "" {
+		return route.Default(), nil
+	}
+	return route.Load(path)
+}
+
+type doneKey struct{}
+
+func NewReverseProxy(reg registry.Registry, routes *route.Table, balancers *balancer.Group, hashKey balancer.KeySource, transports *transportPool, logger log.Logger) *httputil.ReverseProxy {
 	director := func(req *http.Request) {
-		reqPath := req.URL.Path
-		if reqPath == "" {
+		match, ok := routes.Match(req)
+		if !ok {
+			logger.Log("reverseProxy failed", "no route", req.URL.Path)
 			return
 		}
-		// /biz/add/1/2
-		pathArray := strings.Split(reqPath, "/")
-		serviceName := pathArray[1]
+		serviceName := match.Service
 		logger.Log("serviceName:", serviceName)
 
-		result, _, err := client.Catalog().Service(serviceName, "", nil)
+		result, err := reg.Instances(serviceName)
 		if err != nil {
 			logger.Log("reverseProxy failed", "query service instance error", err.Error())
 			return
@@ -127,19 +380,47 @@ func NewReverseProxy(client *api.Client, tracer *zipkin.Tracer, logger log.Logge
 			return
 		}
 
-		destPath := strings.Join(pathArray[2:], "/")
-		tgt := result[rand.Int()%len(result)]
-		logger.Log("service id", tgt.ServiceID)
+		tgt, done, err := balancers.Get(serviceName).Pick(balancer.WithKey(req.Context(), hashKey.Key(req)), result)
+		if err != nil {
+			logger.Log("reverseProxy failed", "pick service instance error", err.Error())
+			return
+		}
+		*req = *req.WithContext(context.WithValue(req.Context(), doneKey{}, done))
 
-		req.URL.Scheme = "http"
-		req.URL.Host = fmt.Sprintf("%s:%d", tgt.ServiceAddress, tgt.ServicePort)
-		req.URL.Path = "/" + destPath
+		logger.Log("service id", tgt.ID)
+
+		req.URL.Scheme = transports.Scheme()
+		req.URL.Host = tgt.HostPort()
+		req.URL.Path = match.Path
+		req.URL.RawPath = ""
+		accesslog.SetRoute(req.Context(), match.Route.Name)
+		accesslog.SetUpstream(req.Context(), req.URL.Host)
 	}
 
-	roundTrip, _ := zipkinHttpsvr.NewTransport(tracer, zipkinHttpsvr.TransportTrace(true))
+	// a single proxy serves every upstream, so they share one transport
+	roundTrip := transports.Get("*")
+
+	finish := func(req *http.Request, err error) {
+		if done, ok := req.Context().Value(doneKey{}).(balancer.Done); ok {
+			done(err)
+		}
+	}
 
 	return &httputil.ReverseProxy{
 		Director:  director,
 		Transport: roundTrip,
+		ModifyResponse: func(resp *http.Response) error {
+			if resp.StatusCode >= 500 {
+				finish(resp.Request, balancer.StatusError{Code: resp.StatusCode, Err: errors.New(resp.Status)})
+			} else {
+				finish(resp.Request, nil)
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			finish(req, err)
+			logger.Log("reverseProxy failed", err.Error())
+			w.WriteHeader(http.StatusBadGateway)
+		},
 	}
 }
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"go-kit-one/pkg/balancer"
+	"go-kit-one/pkg/plugin"
+	"go-kit-one/pkg/registry"
+	"go-kit-one/pkg/route"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// mirrorMaxBody bounds the request and response bodies kept per mirrored
+	// request, larger requests aren't mirrored and larger responses aren't
+	// compared.
+	mirrorMaxBody = 1 << 20
+	// mirrorInFlight bounds the shadow requests running at once, requests
+	// above it aren't mirrored so a slow shadow can't pile up goroutines.
+	mirrorInFlight  = 64
+	mirrorKeptDiffs = 50
+	mirrorMaxDiffs  = 10
+)
+
+var ErrMirrorTooLarge = errors.New("body too large to mirror")
+
+// MirrorDiff is a shadow response that didn't match the primary one.
+type MirrorDiff struct {
+	Time         time.Time `json:"time"`
+	Route        string    `json:"route"`
+	Service      string    `json:"service"`
+	Method       string    `json:"method"`
+	Path         string    `json:"path"`
+	Status       int       `json:"status"`
+	ShadowStatus int       `json:"shadow_status"`
+	Diffs        []string  `json:"diffs"`
+}
+
+// Mirrorer sends copies of requests to the shadow services of their routes,
+// in the background, and counts the outcome per route as mirrored, match,
+// mismatch, error, dropped, too_large or incomplete.
+type Mirrorer struct {
+	registry   registry.Registry
+	balancers  *balancer.Group
+	transports *transportPool
+	requests   metrics.Counter
+	logger     log.Logger
+	slots      chan struct{}
+
+	mtx   sync.Mutex
+	diffs []MirrorDiff
+}
+
+func NewMirrorer(reg registry.Registry, balancers *balancer.Group, transports *transportPool, requests metrics.Counter, logger log.Logger) *Mirrorer {
+	return &Mirrorer{
+		registry:   reg,
+		balancers:  balancers,
+		transports: transports,
+		requests:   requests,
+		logger:     logger,
+		slots:      make(chan struct{}, mirrorInFlight),
+	}
+}
+
+// Start mirrors r if its route asks for it. The primary response has to be
+// written to the returned writer and finish called once it's done, with
+// whether it's complete: a response run gave up on is written on after
+// finish and isn't compared.
+func (m *Mirrorer) Start(w http.ResponseWriter, r *http.Request, match route.Match) (http.ResponseWriter, func(completed bool)) {
+	mirror := match.Route.Mirror
+	if mirror == nil || rand.Float64()*100 >= mirror.MirroredPercent() {
+		return w, func(bool) {}
+	}
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		m.count(match, "dropped")
+		return w, func(bool) {}
+	}
+
+	body, err := m.readBody(r)
+	if err != nil {
+		<-m.slots
+		m.count(match, "too_large")
+		return w, func(bool) {}
+	}
+
+	// the shadow request outlives the client's, it only shares the timeout
+	ctx, cancel := context.WithTimeout(context.Background(), match.Route.TimeoutDuration())
+	ctx = plugin.WithClaims(ctx, plugin.Claims(r.Context()))
+	out := r.Clone(ctx)
+	out.RequestURI = ""
+	out.URL.Scheme = m.transports.Scheme()
+	out.URL.Path = match.Path
+	out.URL.RawPath = ""
+	out.Header.Set("X-Mirror", "true")
+	out.Body = ioutil.NopCloser(bytes.NewReader(body))
+	out.ContentLength = int64(len(body))
+
+	// the shadow goes through the route's plugins like the primary, or
+	// routes rewriting responses would never match
+	plugins := match.Route.PluginChain()
+	if err := plugins.Before(out); err != nil {
+		cancel()
+		<-m.slots
+		m.logger.Log("route", match.Route.Name, "mirror", mirror.Service, "err", err)
+		m.count(match, "error")
+		return w, func(bool) {}
+	}
+
+	var capture *captureWriter
+	if mirror.Compare {
+		capture = &captureWriter{ResponseWriter: w, limit: mirrorMaxBody}
+		w = capture
+	}
+	primaryDone := make(chan struct{})
+	var primaryCompleted bool
+
+	go func() {
+		defer func() { <-m.slots }()
+		defer cancel()
+
+		resp, err := m.send(ctx, mirror, out)
+		if err != nil {
+			m.logger.Log("route", match.Route.Name, "mirror", mirror.Service, "err", err)
+			m.count(match, "error")
+			return
+		}
+		if err := plugins.After(resp); err != nil {
+			resp.Body.Close()
+			m.logger.Log("route", match.Route.Name, "mirror", mirror.Service, "err", err)
+			m.count(match, "error")
+			return
+		}
+		shadowBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, mirrorMaxBody+1))
+		resp.Body.Close()
+		if err != nil {
+			m.logger.Log("route", match.Route.Name, "mirror", mirror.Service, "err", err)
+			m.count(match, "error")
+			return
+		}
+		if capture == nil {
+			m.count(match, "mirrored")
+			return
+		}
+
+		<-primaryDone
+		if !primaryCompleted {
+			m.count(match, "incomplete")
+			return
+		}
+		status, primaryBody, truncated := capture.snapshot()
+		if truncated || len(shadowBody) > mirrorMaxBody {
+			m.count(match, "too_large")
+			return
+		}
+		diffs := compareResponses(status, primaryBody, resp.StatusCode, shadowBody)
+		if len(diffs) == 0 {
+			m.count(match, "match")
+			return
+		}
+		m.count(match, "mismatch")
+		m.record(MirrorDiff{
+			Time:         time.Now(),
+			Route:        match.Route.Name,
+			Service:      mirror.Service,
+			Method:       r.Method,
+			Path:         match.Path,
+			Status:       status,
+			ShadowStatus: resp.StatusCode,
+			Diffs:        diffs,
+		})
+	}()
+
+	return w, func(completed bool) {
+		primaryCompleted = completed
+		close(primaryDone)
+	}
+}
+
+// readBody reads the body for the shadow request and puts it back for the
+// primary one.
+func (m *Mirrorer) readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, mirrorMaxBody+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > mirrorMaxBody {
+		return nil, ErrMirrorTooLarge
+	}
+	return body, nil
+}
+
+func (m *Mirrorer) send(ctx context.Context, mirror *route.Mirror, out *http.Request) (*http.Response, error) {
+	instances, err := m.registry.Instances(mirror.Service, mirror.Tags...)
+	if err != nil {
+		return nil, err
+	}
+	if len(instances) == 0 {
+		return nil, balancer.ErrNoInstances
+	}
+	inst, done, err := m.balancers.Get(mirror.Service).Pick(ctx, instances)
+	if err != nil {
+		return nil, err
+	}
+	out.URL.Host = inst.HostPort()
+	resp, err := m.transports.Get(mirror.Service).RoundTrip(out)
+	if err != nil {
+		done(err)
+		return nil, err
+	}
+	if resp.StatusCode >= 500 {
+		done(balancer.StatusError{Code: resp.StatusCode, Err: errors.New(resp.Status)})
+	} else {
+		done(nil)
+	}
+	return resp, nil
+}
+
+func (m *Mirrorer) count(match route.Match, result string) {
+	m.requests.With("route", match.Route.Name, "result", result).Add(1)
+}
+
+func (m *Mirrorer) record(diff MirrorDiff) {
+	m.logger.Log("route", diff.Route, "mirror", diff.Service, "mismatch", fmt.Sprint(diff.Diffs))
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.diffs = append(m.diffs, diff)
+	if len(m.diffs) > mirrorKeptDiffs {
+		m.diffs = m.diffs[len(m.diffs)-mirrorKeptDiffs:]
+	}
+}
+
+// Diffs returns the latest mismatches, oldest first.
+func (m *Mirrorer) Diffs() []MirrorDiff {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return append([]MirrorDiff(nil), m.diffs...)
+}
+
+// captureWriter keeps the status and the first limit bytes of a response
+// written through it, for comparing or caching it. A proxy hystrix gave up
+// on can still be writing while the capture is read, hence the lock.
+type captureWriter struct {
+	http.ResponseWriter
+	limit int
+
+	mtx       sync.Mutex
+	status    int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (cw *captureWriter) WriteHeader(code int) {
+	cw.mtx.Lock()
+	if cw.status == 0 {
+		cw.status = code
+	}
+	cw.mtx.Unlock()
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	cw.mtx.Lock()
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if room := cw.limit - cw.body.Len(); room < len(b) {
+		cw.truncated = true
+		cw.body.Write(b[:room])
+	} else {
+		cw.body.Write(b)
+	}
+	cw.mtx.Unlock()
+	return cw.ResponseWriter.Write(b)
+}
+
+// snapshot returns the status, a copy of the captured body and whether it
+// was cut at the limit.
+func (cw *captureWriter) snapshot() (int, []byte, bool) {
+	cw.mtx.Lock()
+	defer cw.mtx.Unlock()
+	status := cw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return status, append([]byte(nil), cw.body.Bytes()...), cw.truncated
+}
+
+func (cw *captureWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// compareResponses lists how the shadow response differs from the primary
+// one. JSON bodies are compared field by field, others byte by byte.
+func compareResponses(status int, body []byte, shadowStatus int, shadowBody []byte) []string {
+	var diffs []string
+	if status != shadowStatus {
+		diffs = append(diffs, fmt.Sprintf("status: %d != %d", status, shadowStatus))
+	}
+	var primary, shadow interface{}
+	if json.Unmarshal(body, &primary) == nil && json.Unmarshal(shadowBody, &shadow) == nil {
+		return diffJSON("$", primary, shadow, diffs)
+	}
+	if !bytes.Equal(body, shadowBody) {
+		i := 0
+		for i < len(body) && i < len(shadowBody) && body[i] == shadowBody[i] {
+			i++
+		}
+		diffs = append(diffs, fmt.Sprintf("body: differs at byte %d, %d != %d bytes", i, len(body), len(shadowBody)))
+	}
+	return diffs
+}
+
+// missing stands for an object field only one of the responses has.
+type missing struct{}
+
+func diffJSON(path string, primary, shadow interface{}, diffs []string) []string {
+	if len(diffs) >= mirrorMaxDiffs {
+		return diffs
+	}
+	switch p := primary.(type) {
+	case map[string]interface{}:
+		s, ok := shadow.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(p)+len(s))
+		for k := range p {
+			keys = append(keys, k)
+		}
+		for k := range s {
+			if _, ok := p[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			pv, ok := p[k]
+			if !ok {
+				pv = missing{}
+			}
+			sv, ok := s[k]
+			if !ok {
+				sv = missing{}
+			}
+			diffs = diffJSON(path+"."+k, pv, sv, diffs)
+		}
+		return diffs
+	case []interface{}:
+		s, ok := shadow.([]interface{})
+		if !ok {
+			break
+		}
+		if len(p) != len(s) {
+			return append(diffs, fmt.Sprintf("%s: length %d != %d", path, len(p), len(s)))
+		}
+		for i := range p {
+			diffs = diffJSON(fmt.Sprintf("%s[%d]", path, i), p[i], s[i], diffs)
+		}
+		return diffs
+	}
+	if !reflect.DeepEqual(primary, shadow) {
+		diffs = append(diffs, fmt.Sprintf("%s: %s != %s", path, jsonValue(primary), jsonValue(shadow)))
+	}
+	return diffs
+}
+
+func jsonValue(v interface{}) string {
+	if _, ok := v.(missing); ok {
+		return "<missing>"
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
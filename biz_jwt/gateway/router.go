@@ -1,96 +1,410 @@
 package main
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"github.com/afex/hystrix-go/hystrix"
 	"github.com/go-kit/kit/log"
-	"github.com/hashicorp/consul/api"
-	"github.com/openzipkin/zipkin-go"
-	zipkinHttpsvr "github.com/openzipkin/zipkin-go/middleware/http"
-	"math/rand"
+	"github.com/go-kit/kit/metrics"
+	"go-kit-one/pkg/accesslog"
+	"go-kit-one/pkg/balancer"
+	"go-kit-one/pkg/plugin"
+	"go-kit-one/pkg/registry"
+	"go-kit-one/pkg/retry"
+	"go-kit-one/pkg/route"
 	"net/http"
 	"net/http/httputil"
-	"strings"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// VersionMetrics count and time the requests of split routes per version,
+// labeled with route, service, version and code.
+type VersionMetrics struct {
+	Requests metrics.Counter
+	Latency  metrics.Histogram
+}
+
+var ErrNoServiceInstance = errors.New("no such service instance")
+
 type HystrixRouter struct {
-	svcMap       *sync.Map
-	logger       log.Logger
-	fallbackMsg  string
-	consulClient *api.Client
-	tracer       *zipkin.Tracer
+	svcMap        *sync.Map
+	logger        log.Logger
+	fallbackMsg   string
+	registry      registry.Registry
+	balancers     *balancer.Group
+	hashKey       balancer.KeySource
+	retry         retry.Policy
+	transports    *transportPool
+	proxies       *sync.Map
+	streamProxies *sync.Map
+	buffers       httputil.BufferPool
+	routes        atomic.Value
+	jwtSecret     []byte
+	drained       *sync.Map
+	overrides     *sync.Map
+	versions      VersionMetrics
+	mirrorer      *Mirrorer
+	cache         *ResponseCache
+	streams       StreamMetrics
+	streamCounts  *sync.Map
 }
 
-func NewRoutes(client *api.Client, tracer *zipkin.Tracer, fbMsg string, logger log.Logger) http.Handler {
-	return &HystrixRouter{
-		svcMap:       &sync.Map{},
-		logger:       logger,
-		fallbackMsg:  fbMsg,
-		consulClient: client,
-		tracer:       tracer,
+func NewRoutes(reg registry.Registry, routes *route.Table, jwtSecret []byte, balancers *balancer.Group, hashKey balancer.KeySource, retryPolicy retry.Policy, transports *transportPool, versions VersionMetrics, mirrorer *Mirrorer, cache *ResponseCache, streams StreamMetrics, fbMsg string, logger log.Logger) *HystrixRouter {
+	router := &HystrixRouter{
+		svcMap:        &sync.Map{},
+		logger:        logger,
+		fallbackMsg:   fbMsg,
+		registry:      reg,
+		balancers:     balancers,
+		hashKey:       hashKey,
+		retry:         retryPolicy,
+		transports:    transports,
+		proxies:       &sync.Map{},
+		streamProxies: &sync.Map{},
+		buffers:       newBufferPool(),
+		jwtSecret:     jwtSecret,
+		drained:       &sync.Map{},
+		overrides:     &sync.Map{},
+		versions:      versions,
+		mirrorer:      mirrorer,
+		cache:         cache,
+		streams:       streams,
+		streamCounts:  &sync.Map{},
 	}
+	router.SetRoutes(routes)
+	return router
 }
 
-func (router *HystrixRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// /biz/add/1/2
-	reqPath := r.URL.Path
-	if reqPath == "" {
-		return
-	}
+func (router *HystrixRouter) Routes() *route.Table {
+	return router.routes.Load().(*route.Table)
+}
 
-	pathArray := strings.Split(reqPath, "/")
-	serviceName := pathArray[1]
+// SetRoutes swaps the route table in for the following requests.
+func (router *HystrixRouter) SetRoutes(routes *route.Table) {
+	router.routes.Store(routes)
+}
 
-	if _, ok := router.svcMap.Load(serviceName); !ok {
-		hystrix.ConfigureCommand(serviceName, hystrix.CommandConfig{Timeout: 1000})
-		router.svcMap.Store(serviceName, serviceName)
+func (router *HystrixRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	match, ok := router.Routes().Match(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
 	}
+	accesslog.SetRoute(r.Context(), match.Route.Name)
 
-	err := hystrix.Do(serviceName, func() (err error) {
-		result, _, err := router.consulClient.Catalog().Service(serviceName, "", nil)
+	if match.Route.Auth {
+		claims, err := router.authorize(r)
 		if err != nil {
-			router.logger.Log("reverseProxy failed", "query service instance error", err.Error())
+			router.logger.Log("route", match.Route.Name, "unauthorized", err.Error())
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(err.Error()))
 			return
 		}
+		r = r.WithContext(plugin.WithClaims(r.Context(), claims))
+	}
 
-		if len(result) == 0 {
-			router.logger.Log("reverseProxy failed", "no such service instance", serviceName)
-			return errors.New("no such service instance")
-		}
+	if kind := streamKind(r); kind != "" && match.Route.Compose == nil {
+		router.stream(w, r, match, kind)
+		return
+	}
 
-		director := func(req *http.Request) {
-			destPath := strings.Join(pathArray[2:], "/")
-			tgt := result[rand.Int()%len(result)]
-			router.logger.Log("service id", tgt.ServiceID)
+	router.cache.Serve(w, r, match, func(w http.ResponseWriter) bool {
+		return router.forward(w, r, match)
+	})
+}
 
-			req.URL.Scheme = "http"
-			req.URL.Host = fmt.Sprintf("%s:%d", tgt.ServiceAddress, tgt.ServicePort)
-			req.URL.Path = "/" + destPath
-		}
+// forward answers a matched and authorized request from upstream. It
+// reports whether the response is complete, which it isn't when hystrix
+// gave up on the upstream request while it was still being written.
+func (router *HystrixRouter) forward(w http.ResponseWriter, r *http.Request, match route.Match) bool {
+	serviceName := match.Service
+	if match.Route.Compose != nil {
+		router.compose(w, r, match)
+		return true
+	}
+
+	// services without instances, such as random first path segments on
+	// the default route, are answered before they get a circuit of their own
+	if instances, err := router.registry.Instances(serviceName); err == nil && len(instances) == 0 {
+		http.Error(w, ErrNoServiceInstance.Error(), http.StatusServiceUnavailable)
+		return true
+	}
 
-		var proxyError error = nil
-		roundTrip, _ := zipkinHttpsvr.NewTransport(router.tracer, zipkinHttpsvr.TransportTrace(true))
+	// every route gets its own circuit per service, since timeouts are per route
+	command := match.Route.Name + "/" + serviceName
+	router.configure(command, match.Route.TimeoutDuration())
 
-		errorHandler := func(ew http.ResponseWriter, er *http.Request, err error) {
-			proxyError = err
+	var version *route.Version
+	if match.Route.Split != nil {
+		version = match.Route.Split.Choose(r)
+		rw := accesslog.NewResponseWriter(w)
+		begin := time.Now()
+		defer func() {
+			labels := []string{"route", match.Route.Name, "service", serviceName, "version", version.Name, "code", strconv.Itoa(rw.Status())}
+			router.versions.Requests.With(labels...).Add(1)
+			router.versions.Latency.With(labels...).Observe(time.Since(begin).Seconds())
+		}()
+		w = rw
+	}
+
+	var completed int32
+	w, finishMirror := router.mirrorer.Start(w, r, match)
+	defer func() { finishMirror(atomic.LoadInt32(&completed) == 1) }()
+
+	gw := newGuardedWriter(w)
+	run := func(ctx context.Context) error {
+		instances, err := router.instances(match, version)
+		if err != nil {
+			return err
 		}
-		proxy := &httputil.ReverseProxy{
-			Director:     director,
-			Transport:    roundTrip,
-			ErrorHandler: errorHandler,
+		call := &proxyCall{instances: instances, path: match.Path, plugins: match.Route.PluginChain()}
+		out, err := router.upstreamRequest(r.WithContext(ctx), call)
+		if err != nil {
+			return err
 		}
-
-		proxy.ServeHTTP(w, r)
-		return proxyError
-	}, func(err error) error {
+		router.proxy(serviceName).ServeHTTP(gw, out)
+		if gw.complete() {
+			atomic.StoreInt32(&completed, 1)
+		}
+		return call.err
+	}
+	fallback := func(err error) error {
 		router.logger.Log("fallback error desc", err.Error())
 		return errors.New(router.fallbackMsg)
-	})
+	}
 
-	if err != nil {
+	err := router.do(r.Context(), command, match.Route.TimeoutDuration(), run, fallback)
+	// a response run started stays as far as it got, the client can't be
+	// told otherwise anymore
+	if wrote := gw.close(); err != nil && !wrote {
 		w.WriteHeader(500)
 		w.Write([]byte(err.Error()))
 	}
+	return atomic.LoadInt32(&completed) == 1
+}
+
+// guardedWriter is the writer run proxies to. At its timeout hystrix
+// returns from do while run is still going, so do's return closes the
+// writer: writes after it are dropped, and forward answers with the error
+// only when run hadn't written anything. The headers are kept apart until
+// the response starts, so forward and run never share the header map.
+type guardedWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+
+	mtx    sync.Mutex
+	wrote  bool
+	closed bool
+}
+
+func newGuardedWriter(w http.ResponseWriter) *guardedWriter {
+	return &guardedWriter{w: w, header: make(http.Header)}
+}
+
+func (g *guardedWriter) Header() http.Header {
+	return g.header
+}
+
+func (g *guardedWriter) WriteHeader(code int) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if !g.closed {
+		g.writeHeader(code)
+	}
+}
+
+func (g *guardedWriter) Write(b []byte) (int, error) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if g.closed {
+		return 0, http.ErrHandlerTimeout
+	}
+	g.writeHeader(http.StatusOK)
+	return g.w.Write(b)
+}
+
+func (g *guardedWriter) Flush() {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if g.closed {
+		return
+	}
+	g.writeHeader(http.StatusOK)
+	if f, ok := g.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// writeHeader must be called with mtx held.
+func (g *guardedWriter) writeHeader(code int) {
+	if g.wrote {
+		return
+	}
+	g.wrote = true
+	g.copyHeader()
+	g.w.WriteHeader(code)
+}
+
+func (g *guardedWriter) copyHeader() {
+	for name, values := range g.header {
+		g.w.Header()[name] = values
+	}
+}
+
+// complete is called by run once the response is written, and passes on
+// trailers set after the body. It reports false when the writer was closed
+// first.
+func (g *guardedWriter) complete() bool {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if g.closed {
+		return false
+	}
+	g.copyHeader()
+	return true
+}
+
+// close drops later writes and reports whether any response was written.
+func (g *guardedWriter) close() bool {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.closed = true
+	return g.wrote
+}
+
+// instances returns the instances a request of match may go to: the
+// service's instances that aren't drained, restricted to version if any.
+func (router *HystrixRouter) instances(match route.Match, version *route.Version) ([]registry.Instance, error) {
+	serviceName := match.Service
+	result, err := router.registry.Instances(serviceName)
+	if err != nil {
+		router.logger.Log("reverseProxy failed", "query service instance error", err.Error())
+		return nil, err
+	}
+	result = router.undrained(serviceName, result)
+	if version != nil {
+		// a version without instances left doesn't fail the request,
+		// the other versions take its traffic
+		if instances := version.Instances(result); len(instances) > 0 {
+			result = instances
+		} else {
+			router.logger.Log("route", match.Route.Name, "version", version.Name, "no instances", "using all versions")
+		}
+	}
+
+	if len(result) == 0 {
+		router.logger.Log("reverseProxy failed", "no such service instance", serviceName)
+		return nil, ErrNoServiceInstance
+	}
+	return result, nil
+}
+
+// upstreamRequest is r carrying call for the service proxy, run through
+// the route's plugins.
+func (router *HystrixRouter) upstreamRequest(r *http.Request, call *proxyCall) (*http.Request, error) {
+	ctx := context.WithValue(balancer.WithKey(r.Context(), router.hashKey.Key(r)), proxyCallKey{}, call)
+	if len(call.plugins) == 0 {
+		return r.WithContext(ctx), nil
+	}
+	// plugins see the upstream path, the director keeps theirs; the clone
+	// keeps their header changes away from cache and mirror
+	out := r.Clone(ctx)
+	out.URL.Path, out.URL.RawPath = call.path, ""
+	if err := call.plugins.Before(out); err != nil {
+		return nil, err
+	}
+	call.path = out.URL.Path
+	return out, nil
+}
+
+// configure sets up the hystrix command, again whenever its timeout changes.
+func (router *HystrixRouter) configure(command string, timeout time.Duration) {
+	ms := int(timeout / time.Millisecond)
+	if configured, ok := router.svcMap.Load(command); !ok || configured.(int) != ms {
+		hystrix.ConfigureCommand(command, hystrix.CommandConfig{Timeout: ms})
+		router.svcMap.Store(command, ms)
+	}
+}
+
+// do runs command under its circuit, unless an override forces the circuit
+// open or closed. run gets a ctx ending after timeout, or when do returns:
+// hystrix gives up on run at its timeout without stopping it, and a forced
+// closed circuit has no timeout of its own.
+func (router *HystrixRouter) do(ctx context.Context, command string, timeout time.Duration, run func(context.Context) error, fallback func(error) error) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	switch router.CircuitOverride(command) {
+	case CircuitForcedOpen:
+		return fallback(ErrCircuitForcedOpen)
+	case CircuitForcedClosed:
+		return run(ctx)
+	}
+	return hystrix.Do(command, func() error { return run(ctx) }, fallback)
+}
+
+// proxy returns the reverse proxy of a service, built on first use and
+// shared by all its requests so upstream connections are kept alive.
+func (router *HystrixRouter) proxy(serviceName string) *httputil.ReverseProxy {
+	if proxy, ok := router.proxies.Load(serviceName); ok {
+		return proxy.(*httputil.ReverseProxy)
+	}
+
+	// every service keeps its own latency history for hedging, while the
+	// retry budget stays shared across services
+	policy := router.retry
+	policy.Latency = retry.NewLatencyTracker()
+
+	proxy, _ := router.proxies.LoadOrStore(serviceName, router.newProxy(serviceName, policy))
+	return proxy.(*httputil.ReverseProxy)
+}
+
+// streamProxy is the proxy of a service for WebSocket and SSE connections,
+// which are never retried nor hedged.
+func (router *HystrixRouter) streamProxy(serviceName string) *httputil.ReverseProxy {
+	if proxy, ok := router.streamProxies.Load(serviceName); ok {
+		return proxy.(*httputil.ReverseProxy)
+	}
+	proxy, _ := router.streamProxies.LoadOrStore(serviceName, router.newProxy(serviceName, retry.Policy{Attempts: 1}))
+	return proxy.(*httputil.ReverseProxy)
+}
+
+func (router *HystrixRouter) newProxy(serviceName string, policy retry.Policy) *httputil.ReverseProxy {
+	transport := &upstreamTransport{
+		balancer: router.balancers.Get(serviceName),
+		policy:   policy,
+		next:     router.transports.Get(serviceName),
+		logger:   router.logger,
+	}
+
+	director := func(req *http.Request) {
+		req.URL.Scheme = router.transports.Scheme()
+		if call, ok := req.Context().Value(proxyCallKey{}).(*proxyCall); ok {
+			req.URL.Path = call.path
+			req.URL.RawPath = ""
+		}
+	}
+
+	errorHandler := func(ew http.ResponseWriter, er *http.Request, err error) {
+		if call, ok := er.Context().Value(proxyCallKey{}).(*proxyCall); ok {
+			call.err = err
+		}
+	}
+
+	modifyResponse := func(resp *http.Response) error {
+		if call, ok := resp.Request.Context().Value(proxyCallKey{}).(*proxyCall); ok {
+			return call.plugins.After(resp)
+		}
+		return nil
+	}
+
+	return &httputil.ReverseProxy{
+		Director:       director,
+		Transport:      transport,
+		ModifyResponse: modifyResponse,
+		ErrorHandler:   errorHandler,
+		BufferPool:     router.buffers,
+	}
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"go-kit-one/pkg/registry"
+	"go-kit-one/pkg/route"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestGuardedWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	gw := newGuardedWriter(rec)
+	gw.Header().Set("X-Upstream", "1")
+	if rec.Header().Get("X-Upstream") != "" {
+		t.Fatal("headers passed on before the response started")
+	}
+	if gw.close() {
+		t.Fatal("close reports a response nothing was written to")
+	}
+	if _, err := gw.Write([]byte("late")); err != http.ErrHandlerTimeout {
+		t.Fatalf("write after close: %v", err)
+	}
+	if gw.complete() {
+		t.Fatal("complete after close")
+	}
+	if rec.Body.Len() != 0 || rec.Header().Get("X-Upstream") != "" {
+		t.Fatalf("closed writer wrote %q %v", rec.Body.String(), rec.Header())
+	}
+
+	rec = httptest.NewRecorder()
+	gw = newGuardedWriter(rec)
+	gw.Header().Set("X-Upstream", "1")
+	gw.WriteHeader(http.StatusAccepted)
+	gw.Write([]byte("body"))
+	if !gw.complete() || !gw.close() {
+		t.Fatal("written response not complete")
+	}
+	if rec.Code != http.StatusAccepted || rec.Body.String() != "body" || rec.Header().Get("X-Upstream") != "1" {
+		t.Fatalf("got %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+}
+
+// TestForwardTimeout checks the upstream request ends at the route timeout
+// and the client gets the fallback.
+func TestForwardTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+			w.Write([]byte("late"))
+		}
+	}))
+	defer backend.Close()
+	host, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	reg := registry.NewMemory()
+	if err := reg.Register(registry.Instance{ID: "slow-1", Service: "slow", Address: host, Port: p}); err != nil {
+		t.Fatal(err)
+	}
+	router := newTestRouter(t, reg)
+	table, err := route.Parse([]byte(`{"routes": [{"name": "slow", "path_prefix": "/slow/", "service": "slow", "timeout": "100ms"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.SetRoutes(table)
+
+	begin := time.Now()
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/slow/x", nil))
+	if elapsed := time.Since(begin); elapsed > 2*time.Second {
+		t.Fatalf("request took %v", elapsed)
+	}
+	if rec.Code != http.StatusInternalServerError || rec.Body.String() != "circuit breaker:service unavailable" {
+		t.Fatalf("got %d %q", rec.Code, rec.Body.String())
+	}
+}
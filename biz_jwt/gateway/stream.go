@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/go-kit/kit/metrics"
+	"go-kit-one/pkg/route"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StreamWebSocket = "websocket"
+	StreamSSE       = "sse"
+)
+
+var (
+	ErrStreamLimit   = errors.New("too many stream connections on this route")
+	ErrNotHijackable = errors.New("response writer does not support hijacking")
+)
+
+// StreamMetrics count the open stream connections, labeled with route and
+// kind, and the closed ones, labeled with route, kind and reason: done,
+// error, idle or lifetime.
+type StreamMetrics struct {
+	Open   metrics.Gauge
+	Closed metrics.Counter
+}
+
+// streamKind recognizes WebSocket upgrades and Server-Sent Events requests.
+func streamKind(r *http.Request) string {
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") && headerHasToken(r.Header, "Connection", "upgrade") {
+		return StreamWebSocket
+	}
+	if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		return StreamSSE
+	}
+	return ""
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stream proxies a WebSocket or SSE connection. It bypasses hystrix, whose
+// timeout would cut it, as well as the cache and mirroring; the route's
+// stream limits close it when idle or too old instead.
+func (router *HystrixRouter) stream(w http.ResponseWriter, r *http.Request, match route.Match, kind string) {
+	limits := match.Route.StreamLimits()
+	open := router.streamCount(match.Route.Name)
+	if n := atomic.AddInt64(open, 1); limits.MaxConnections > 0 && n > int64(limits.MaxConnections) {
+		atomic.AddInt64(open, -1)
+		router.streams.Closed.With("route", match.Route.Name, "kind", kind, "reason", "limit").Add(1)
+		http.Error(w, ErrStreamLimit.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer atomic.AddInt64(open, -1)
+	router.streams.Open.With("route", match.Route.Name, "kind", kind).Add(1)
+	defer router.streams.Open.With("route", match.Route.Name, "kind", kind).Add(-1)
+
+	var version *route.Version
+	if match.Route.Split != nil {
+		version = match.Route.Split.Choose(r)
+	}
+	instances, err := router.instances(match, version)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	sw := &streamWriter{ResponseWriter: w}
+	sw.touch()
+
+	var reason atomic.Value
+	go func() {
+		lifetime := time.NewTimer(limits.LifetimeDuration())
+		defer lifetime.Stop()
+		interval := limits.IdleDuration() / 4
+		if interval > time.Second {
+			interval = time.Second
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-lifetime.C:
+				reason.Store("lifetime")
+				cancel()
+				return
+			case <-ticker.C:
+				if sw.idle() > limits.IdleDuration() {
+					reason.Store("idle")
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	call := &proxyCall{instances: instances, path: match.Path, plugins: match.Route.PluginChain()}
+	out, err := router.upstreamRequest(r.WithContext(ctx), call)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	// the proxy aborts the handler with a panic when the copy of a streamed
+	// body fails, cancelled by the watchdog or not, so the close is counted
+	// on the way out
+	finished := false
+	defer func() {
+		closed, _ := reason.Load().(string)
+		switch {
+		case closed != "":
+		case call.err != nil || !finished:
+			closed = "error"
+		default:
+			closed = "done"
+		}
+		router.streams.Closed.With("route", match.Route.Name, "kind", kind, "reason", closed).Add(1)
+	}()
+	router.streamProxy(match.Service).ServeHTTP(sw, out)
+	finished = true
+
+	if call.err != nil {
+		router.logger.Log("route", match.Route.Name, "stream", kind, "err", call.err)
+		if !sw.wrote {
+			http.Error(w, call.err.Error(), http.StatusBadGateway)
+		}
+	}
+}
+
+func (router *HystrixRouter) streamCount(routeName string) *int64 {
+	count, _ := router.streamCounts.LoadOrStore(routeName, new(int64))
+	return count.(*int64)
+}
+
+// StreamConnections reports the open stream connections per route.
+func (router *HystrixRouter) StreamConnections() map[string]int64 {
+	res := make(map[string]int64)
+	router.streamCounts.Range(func(key, value interface{}) bool {
+		res[key.(string)] = atomic.LoadInt64(value.(*int64))
+		return true
+	})
+	return res
+}
+
+// streamWriter records when data last went through the connection, written
+// as SSE events or in either direction of a hijacked WebSocket.
+type streamWriter struct {
+	http.ResponseWriter
+	last  int64
+	wrote bool
+}
+
+func (sw *streamWriter) touch() {
+	atomic.StoreInt64(&sw.last, time.Now().UnixNano())
+}
+
+func (sw *streamWriter) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&sw.last)))
+}
+
+func (sw *streamWriter) WriteHeader(code int) {
+	sw.wrote = true
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *streamWriter) Write(b []byte) (int, error) {
+	sw.wrote = true
+	sw.touch()
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *streamWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sw *streamWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, ErrNotHijackable
+	}
+	sw.wrote = true
+	conn, brw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &activityConn{Conn: conn, sw: sw}, brw, nil
+}
+
+type activityConn struct {
+	net.Conn
+	sw *streamWriter
+}
+
+func (c *activityConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.sw.touch()
+	}
+	return n, err
+}
+
+func (c *activityConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.sw.touch()
+	}
+	return n, err
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/tls"
+	"github.com/openzipkin/zipkin-go"
+	zipkinHttpsvr "github.com/openzipkin/zipkin-go/middleware/http"
+	"go-kit-one/pkg/tlsconfig"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type TransportConfig struct {
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	// HTTP2 negotiates HTTP/2 with upstreams serving TLS.
+	HTTP2 bool
+	// TLS makes upstream calls https, presenting its certificate and
+	// checking theirs is issued to the service called.
+	TLS *tlsconfig.Store
+}
+
+func newTransport(cfg TransportConfig, serviceName string) *http.Transport {
+	var tlsConfig *tls.Config
+	if cfg.TLS != nil {
+		tlsConfig = cfg.TLS.ClientConfig(serviceName)
+	}
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   cfg.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     cfg.HTTP2,
+		TLSClientConfig:       tlsConfig,
+	}
+}
+
+// transportPool keeps one traced transport per upstream service for the
+// life of the gateway, so connections to its instances are reused.
+type transportPool struct {
+	cfg    TransportConfig
+	tracer *zipkin.Tracer
+
+	mtx        sync.Mutex
+	transports map[string]http.RoundTripper
+}
+
+func newTransportPool(cfg TransportConfig, tracer *zipkin.Tracer) *transportPool {
+	return &transportPool{
+		cfg:        cfg,
+		tracer:     tracer,
+		transports: make(map[string]http.RoundTripper),
+	}
+}
+
+func (p *transportPool) Get(serviceName string) http.RoundTripper {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if rt, ok := p.transports[serviceName]; ok {
+		return rt
+	}
+	rt, _ := zipkinHttpsvr.NewTransport(p.tracer,
+		zipkinHttpsvr.RoundTripper(newTransport(p.cfg, serviceName)),
+		zipkinHttpsvr.TransportTrace(true),
+	)
+	p.transports[serviceName] = rt
+	return rt
+}
+
+// Scheme is the scheme of upstream URLs.
+func (p *transportPool) Scheme() string {
+	if p.cfg.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// bufferPool recycles the copy buffers of the reverse proxies.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool() *bufferPool {
+	return &bufferPool{pool: sync.Pool{New: func() interface{} { return make([]byte, 32*1024) }}}
+}
+
+func (p *bufferPool) Get() []byte {
+	return p.pool.Get().([]byte)
+}
+
+func (p *bufferPool) Put(b []byte) {
+	p.pool.Put(b)
+}
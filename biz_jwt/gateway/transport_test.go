@@ -0,0 +1,90 @@
+package main
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/openzipkin/zipkin-go"
+	zipkinHttpsvr "github.com/openzipkin/zipkin-go/middleware/http"
+	"github.com/openzipkin/zipkin-go/reporter"
+	"go-kit-one/pkg/registry"
+	"go-kit-one/pkg/retry"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strconv"
+	"testing"
+)
+
+// BenchmarkProxyPerRequest builds the traced transport and reverse proxy
+// for every request, on top of http.DefaultTransport, as the router did
+// before upstream transports were shared.
+func BenchmarkProxyPerRequest(b *testing.B) {
+	router, backend := newBenchRouter(b)
+	defer backend.Close()
+	tracer, _ := zipkin.NewTracer(reporter.NewNoopReporter(), zipkin.WithNoopTracer(true))
+
+	benchmarkProxy(b, router, func() *httputil.ReverseProxy {
+		roundTrip, _ := zipkinHttpsvr.NewTransport(tracer, zipkinHttpsvr.TransportTrace(true))
+		return &httputil.ReverseProxy{
+			Director: func(req *http.Request) {
+				req.URL.Scheme = "http"
+				req.URL.Path = "/"
+			},
+			Transport: &upstreamTransport{
+				balancer: router.balancers.Get("biz"),
+				policy:   retry.Policy{Attempts: 1},
+				next:     roundTrip,
+				logger:   log.NewNopLogger(),
+			},
+		}
+	})
+}
+
+// BenchmarkProxyShared goes through the service's shared proxy and pooled
+// transport.
+func BenchmarkProxyShared(b *testing.B) {
+	router, backend := newBenchRouter(b)
+	defer backend.Close()
+
+	benchmarkProxy(b, router, func() *httputil.ReverseProxy {
+		return router.proxy("biz")
+	})
+}
+
+func benchmarkProxy(b *testing.B, router *HystrixRouter, proxy func() *httputil.ReverseProxy) {
+	instances, err := router.registry.Instances("biz")
+	if err != nil || len(instances) == 0 {
+		b.Fatalf("biz instances: %v %v", instances, err)
+	}
+	b.ReportAllocs()
+	b.SetParallelism(4)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			r := httptest.NewRequest("GET", "/biz/", nil)
+			out, err := router.upstreamRequest(r, &proxyCall{instances: instances, path: "/"})
+			if err != nil {
+				b.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			proxy().ServeHTTP(w, out)
+			if w.Code != http.StatusOK {
+				b.Fatalf("status %d", w.Code)
+			}
+		}
+	})
+}
+
+func newBenchRouter(b *testing.B) (*HystrixRouter, *httptest.Server) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"result":3,"error":""}`))
+	}))
+	host, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	reg := registry.NewMemory()
+	p, _ := strconv.Atoi(port)
+	if err := reg.Register(registry.Instance{ID: "biz-1", Service: "biz", Address: host, Port: p}); err != nil {
+		b.Fatal(err)
+	}
+	return newTestRouter(b, reg), backend
+}
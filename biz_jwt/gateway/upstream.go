@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/go-kit/kit/log"
+	"go-kit-one/pkg/accesslog"
+	"go-kit-one/pkg/balancer"
+	"go-kit-one/pkg/plugin"
+	"go-kit-one/pkg/registry"
+	"go-kit-one/pkg/retry"
+	"io/ioutil"
+	"net/http"
+)
+
+// proxyCall carries the per-request state through a shared reverse proxy:
+// the instances to pick from, the upstream path, the route's plugins and the
+// error the proxy ended with.
+type proxyCall struct {
+	instances []registry.Instance
+	path      string
+	plugins   plugin.Chain
+	err       error
+}
+
+type proxyCallKey struct{}
+
+// upstreamTransport picks the instance per attempt, so retries and hedged
+// requests can go to another instance than the first one.
+type upstreamTransport struct {
+	balancer balancer.Balancer
+	policy   retry.Policy
+	next     http.RoundTripper
+	logger   log.Logger
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	call, ok := req.Context().Value(proxyCallKey{}).(*proxyCall)
+	if !ok {
+		return nil, balancer.ErrNoInstances
+	}
+
+	policy := t.policy
+	if !idempotent(req) {
+		policy = policy.NonIdempotent()
+	}
+
+	// the body is read once and replayed on every attempt
+	var body []byte
+	if (policy.Attempts > 1 || policy.HedgePercentile > 0) && req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := policy.Do(balancer.WithTried(req.Context()), func(ctx context.Context) (interface{}, error) {
+		inst, done, err := t.balancer.Pick(ctx, call.instances)
+		if err != nil {
+			return nil, err
+		}
+		t.logger.Log("service id", inst.ID)
+
+		out := req.Clone(ctx)
+		out.URL.Host = inst.HostPort()
+		if body != nil {
+			out.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		accesslog.SetUpstream(ctx, out.URL.Host)
+
+		resp, err := t.next.RoundTrip(out)
+		if err != nil {
+			done(err)
+			return nil, err
+		}
+		if resp.StatusCode >= 500 {
+			statusErr := balancer.StatusError{Code: resp.StatusCode, Err: errors.New(resp.Status)}
+			done(statusErr)
+			return resp, statusErr
+		}
+		done(nil)
+		return resp, nil
+	}, func(res interface{}) {
+		res.(*http.Response).Body.Close()
+	})
+
+	// a 5xx left after the last attempt goes back to the client as is
+	if resp, ok := res.(*http.Response); ok {
+		return resp, nil
+	}
+	return nil, err
+}
+
+// idempotent requests are the only ones retried or hedged, others only when
+// they weren't sent. An Idempotency-Key doesn't make them safe to repeat:
+// the key is only known to the instance that served the request.
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete, http.MethodTrace:
+		return true
+	}
+	return false
+}
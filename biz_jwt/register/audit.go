@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/dgrijalva/jwt-go"
+	kitJwt "github.com/go-kit/kit/auth/jwt"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	kitHttp "github.com/go-kit/kit/transport/http"
+	"go-kit-one/pkg/accesslog"
+	"go-kit-one/pkg/audit"
+	"net"
+	"strings"
+)
+
+// TrustedProxies are the networks of proxies in front of the service, such
+// as the gateway, whose X-Forwarded-For entries are believed.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies reads a comma separated list of CIDRs and addresses.
+func ParseTrustedProxies(s string) (TrustedProxies, error) {
+	var proxies TrustedProxies
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (t TrustedProxies) trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range t {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SourceIP is the address the request came from. X-Forwarded-For is set by
+// the client as much as by proxies, so it's only followed from the peer
+// backwards while the hops are trusted proxies: the first address a trusted
+// proxy didn't add is the source.
+func (t TrustedProxies) SourceIP(ctx context.Context) string {
+	addr, _ := ctx.Value(kitHttp.ContextKeyRequestRemoteAddr).(string)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	xff, _ := ctx.Value(kitHttp.ContextKeyRequestXForwardedFor).(string)
+	hops := strings.Split(xff, ",")
+	for i := len(hops) - 1; i >= 0 && t.trusted(addr); i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			break
+		}
+		addr = hop
+	}
+	return addr
+}
+
+func NewLoginAuditMiddleware(auditor *audit.Auditor, proxies TrustedProxies, logger log.Logger) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			response, err = next(ctx, request)
+
+			req := request.(*AuthRequest)
+			event := audit.Event{
+				User:      req.Name,
+				SourceIP:  proxies.SourceIP(ctx),
+				RequestID: accesslog.RequestID(ctx),
+				Operation: "Login",
+			}
+
+			resp, ok := response.(*AuthResponse)
+			if err != nil || !ok || !resp.Success {
+				event.Type = audit.TypeLoginFailure
+				if err != nil {
+					event.Detail = err.Error()
+				} else if ok {
+					event.Detail = resp.Error
+				}
+				recordAudit(auditor, event, logger)
+				return
+			}
+
+			event.Type = audit.TypeLoginSuccess
+			recordAudit(auditor, event, logger)
+
+			event.Type = audit.TypeTokenIssued
+			event.Claims = tokenClaims(resp.Token)
+			recordAudit(auditor, event, logger)
+			return
+		}
+	}
+}
+
+func NewCallAuditMiddleware(auditor *audit.Auditor, proxies TrustedProxies, logger log.Logger) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			response, err = next(ctx, request)
+
+			event := audit.Event{
+				Type:      audit.TypeCall,
+				SourceIP:  proxies.SourceIP(ctx),
+				RequestID: accesslog.RequestID(ctx),
+			}
+			if req, ok := request.(*BizRequest); ok {
+				event.Operation = req.ReqType
+			}
+			if claims, ok := ctx.Value(kitJwt.JWTClaimsContextKey).(*BizCustomClaim); ok {
+				event.User = claims.Name
+				event.Claims = claimsMap(claims)
+			}
+			if err != nil {
+				event.Detail = err.Error()
+			}
+			recordAudit(auditor, event, logger)
+			return
+		}
+	}
+}
+
+func recordAudit(auditor *audit.Auditor, event audit.Event, logger log.Logger) {
+	if err := auditor.Record(event); err != nil {
+		logger.Log("audit", event.Type, "error", err)
+	}
+}
+
+func tokenClaims(token string) map[string]interface{} {
+	claims := &BizCustomClaim{}
+	if _, err := jwt.ParseWithClaims(token, claims, JwtKeyFunc); err != nil {
+		return nil
+	}
+	return claimsMap(claims)
+}
+
+func claimsMap(claims *BizCustomClaim) map[string]interface{} {
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return nil
+	}
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil
+	}
+	return m
+}
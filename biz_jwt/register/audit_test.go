@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	kitHttp "github.com/go-kit/kit/transport/http"
+	"testing"
+)
+
+func TestSourceIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		proxies TrustedProxies
+		remote  string
+		xff     string
+		want    string
+	}{
+		{nil, "203.0.113.7:5100", "", "203.0.113.7"},
+		// without trusted proxies the header is the client's word
+		{nil, "10.0.0.2:5100", "198.51.100.1", "10.0.0.2"},
+		// a client can't get past the peer by sending its own header
+		{proxies, "203.0.113.7:5100", "198.51.100.1", "203.0.113.7"},
+		{proxies, "10.0.0.2:5100", "198.51.100.1", "198.51.100.1"},
+		// the forged first entry is ignored, the gateway appended the real one
+		{proxies, "10.0.0.2:5100", "1.2.3.4, 198.51.100.1", "198.51.100.1"},
+		{proxies, "10.0.0.2:5100", "1.2.3.4, 198.51.100.1, 192.168.1.5", "198.51.100.1"},
+		{proxies, "10.0.0.2:5100", "", "10.0.0.2"},
+	} {
+		ctx := context.WithValue(context.Background(), kitHttp.ContextKeyRequestRemoteAddr, tc.remote)
+		ctx = context.WithValue(ctx, kitHttp.ContextKeyRequestXForwardedFor, tc.xff)
+		if got := tc.proxies.SourceIP(ctx); got != tc.want {
+			t.Errorf("SourceIP(%s, %q) = %s, want %s", tc.remote, tc.xff, got, tc.want)
+		}
+	}
+}
+
+func TestParseTrustedProxiesInvalid(t *testing.T) {
+	if _, err := ParseTrustedProxies("10.0.0.0/8,gateway"); err == nil {
+		t.Fatal("invalid proxy accepted")
+	}
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
 	"github.com/dgrijalva/jwt-go"
+	kitJwt "github.com/go-kit/kit/auth/jwt"
+	"github.com/go-kit/kit/endpoint"
+	"go-kit-one/pkg/accesslog"
 	"time"
 )
 
@@ -19,6 +23,21 @@ func JwtKeyFunc(token *jwt.Token) (interface{}, error) {
 	return secretKey, nil
 }
 
+func BizClaimsFactory() jwt.Claims {
+	return &BizCustomClaim{}
+}
+
+func NewAccessLogUser() endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			if claims, ok := ctx.Value(kitJwt.JWTClaimsContextKey).(*BizCustomClaim); ok {
+				accesslog.SetUser(ctx, claims.Name)
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
 func Sign(name, uid string) (string, error) {
 	expAt := time.Now().Add(time.Duration(10) * time.Minute).Unix()
 
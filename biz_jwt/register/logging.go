@@ -7,17 +7,21 @@ import (
 
 type LoggingMiddleware struct {
 	Service
-	logger log.Logger
+	logger  log.Logger
+	sampler *LogSampler
 }
 
-func NewLoggingMiddleware(logger log.Logger) ServiceMiddleware {
+func NewLoggingMiddleware(logger log.Logger, sampler *LogSampler) ServiceMiddleware {
 	return func(next Service) Service {
-		return LoggingMiddleware{next, logger}
+		return LoggingMiddleware{next, logger, sampler}
 	}
 }
 
 func (mw LoggingMiddleware) Add(a, b int) (ret int) {
 	defer func(begin time.Time) {
+		if !mw.sampler.Sample("Add", time.Since(begin), nil) {
+			return
+		}
 		mw.logger.Log(
 			"function", "Add",
 			"a", a,
@@ -34,6 +38,9 @@ func (mw LoggingMiddleware) Add(a, b int) (ret int) {
 
 func (mw LoggingMiddleware) Sub(a, b int) (ret int) {
 	defer func(begin time.Time) {
+		if !mw.sampler.Sample("Sub", time.Since(begin), nil) {
+			return
+		}
 		mw.logger.Log(
 			"function", "Sub",
 			"a", a,
@@ -50,6 +57,9 @@ func (mw LoggingMiddleware) Sub(a, b int) (ret int) {
 
 func (mw LoggingMiddleware) Mul(a, b int) (ret int) {
 	defer func(begin time.Time) {
+		if !mw.sampler.Sample("Mul", time.Since(begin), nil) {
+			return
+		}
 		mw.logger.Log(
 			"function", "Mul",
 			"a", a,
@@ -66,11 +76,15 @@ func (mw LoggingMiddleware) Mul(a, b int) (ret int) {
 
 func (mw LoggingMiddleware) Div(a, b int) (ret int, err error) {
 	defer func(begin time.Time) {
+		if !mw.sampler.Sample("Div", time.Since(begin), err) {
+			return
+		}
 		mw.logger.Log(
 			"function", "Div",
 			"a", a,
 			"b", b,
 			"result", ret,
+			"error", err,
 			"cost", time.Since(begin),
 		)
 
@@ -82,6 +96,9 @@ func (mw LoggingMiddleware) Div(a, b int) (ret int, err error) {
 
 func (mw LoggingMiddleware) HealthCheck() (ret bool) {
 	defer func(begin time.Time) {
+		if !mw.sampler.Sample("HealthCheck", time.Since(begin), nil) {
+			return
+		}
 		mw.logger.Log(
 			"function", "HealthCheck",
 			"result", ret,
@@ -95,9 +112,13 @@ func (mw LoggingMiddleware) HealthCheck() (ret bool) {
 
 func (mw LoggingMiddleware) Login(name, pwd string) (token string, err error) {
 	defer func(begin time.Time) {
+		if !mw.sampler.Sample("Login", time.Since(begin), err) {
+			return
+		}
 		mw.logger.Log(
 			"function", "Login",
 			"result", token,
+			"error", err,
 			"took", time.Since(begin),
 		)
 	}(time.Now())
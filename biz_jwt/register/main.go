@@ -12,6 +12,12 @@ import (
 	"github.com/openzipkin/zipkin-go"
 	zipkinHttp "github.com/openzipkin/zipkin-go/reporter/http"
 	stdPrometheus "github.com/prometheus/client_golang/prometheus"
+	"go-kit-one/pkg/accesslog"
+	"go-kit-one/pkg/audit"
+	"go-kit-one/pkg/health"
+	"go-kit-one/pkg/idempotency"
+	"go-kit-one/pkg/registry"
+	"go-kit-one/pkg/tlsconfig"
 	"golang.org/x/time/rate"
 	"net/http"
 	"os"
@@ -23,9 +29,35 @@ import (
 var (
 	consulHost  = flag.String("consul.host", "192.168.0.103", "consul ip address")
 	consulPort  = flag.String("consul.port", "8500", "consul port")
+	registryUrl = flag.String("registry", "", "registry url: consul://, etcd://, file://, dns:// or memory://, defaults to the consul flags")
 	serviceHost = flag.String("service.host", "192.168.0.103", "service ip address")
 	servicePort = flag.String("service.port", "8000", "service port")
+	serviceID   = flag.String("service.id", "", "consul instance id, defaults to name-hostname-port")
+	svcName     = flag.String("service.name", "biz", "consul service name")
+	serviceTags = flag.String("service.tags", "biz,vc", "comma separated consul service tags")
+	svcWeight   = flag.Int("service.weight", 1, "relative routing weight of this instance")
+	svcZone     = flag.String("service.zone", "", "zone of this instance, used for zone-aware routing")
 	zipkinUrl   = flag.String("zipkin.url", "http://192.168.0.103:9411/api/v2/spans", "zipkin server url")
+	logFirst    = flag.Int("log.first", 100, "log the first N calls per method every second, 0 logs everything")
+	logThen     = flag.Int("log.thereafter", 100, "after log.first, log 1 in M calls per method")
+	logSlow     = flag.Duration("log.slow", 100*time.Millisecond, "always log calls slower than this")
+	accessLog   = flag.String("access.log", "combined", "access log format: common, combined, extended, json or empty to disable")
+	checkMode   = flag.String("consul.check", CheckModeHTTP, "consul health check mode: http or ttl")
+	checkTTL    = flag.Duration("consul.check.ttl", 15*time.Second, "ttl of the consul check in ttl mode")
+	deregAfter  = flag.Duration("consul.deregister.after", time.Minute, "deregister the instance after its check is critical this long, 0 disables")
+	drainWait   = flag.Duration("shutdown.drain", 2*time.Second, "wait after entering maintenance before draining connections")
+	healthCache = flag.Duration("health.cache", 5*time.Second, "how long readiness check results are cached")
+	shutdownTTL = flag.Duration("shutdown.timeout", 15*time.Second, "maximum time to drain in-flight requests on shutdown")
+	auditFile   = flag.String("audit.file", "audit.log", "audit log file, empty to disable")
+	auditSize   = flag.Int64("audit.max.size", 100, "rotate the audit log after this many megabytes")
+	auditKeep   = flag.Int("audit.max.backups", 0, "number of rotated audit logs to keep, 0 keeps all")
+	auditProxy  = flag.String("audit.trusted.proxies", "", "comma separated proxy addresses or cidrs whose X-Forwarded-For is used for the audited source ip")
+	idemTTL     = flag.Duration("idempotency.ttl", 24*time.Hour, "how long responses to requests with an Idempotency-Key are replayed")
+	idemKeys    = flag.Int("idempotency.max.keys", 100000, "idempotency keys kept, the least recently used are dropped first")
+	tlsCert     = flag.String("tls.cert", "", "certificate file, serves https when set; reloaded when it changes")
+	tlsKey      = flag.String("tls.key", "", "private key file of tls.cert")
+	tlsCA       = flag.String("tls.ca", "", "ca bundle verifying client certificates")
+	tlsClient   = flag.String("tls.client.auth", "none", "client certificates: none, optional (verified when sent) or require")
 )
 
 func main() {
@@ -56,6 +88,15 @@ func main() {
 		Help:      "total duration of request in microseconds",
 	}, fieldKeys)
 
+	logDropped := kitPrometheus.NewCounterFrom(stdPrometheus.CounterOpts{
+		Namespace: "vince_cfl",
+		Subsystem: "biz_service",
+		Name:      "log_dropped_count",
+		Help:      "numbers of log lines dropped by sampling",
+	}, fieldKeys)
+
+	healthChecker := health.New(*healthCache, 2*time.Second)
+
 	var zipKinTracer *zipkin.Tracer
 	{
 		var (
@@ -63,7 +104,10 @@ func main() {
 			hostPort      = *serviceHost + ":" + *servicePort
 			serviceName   = "biz-service"
 			useNoopTracer = *zipkinUrl == ""
-			reporter      = zipkinHttp.NewReporter(*zipkinUrl)
+			zipkinMonitor = health.NewZipkinMonitor()
+			reporter      = zipkinMonitor.Reporter(zipkinHttp.NewReporter(
+				*zipkinUrl, zipkinHttp.Client(zipkinMonitor.Client(5*time.Second)),
+			))
 		)
 
 		defer reporter.Close()
@@ -78,16 +122,41 @@ func main() {
 		}
 		if !useNoopTracer {
 			logger.Log("tracer", "zipkin", "type", "native", "url", *zipkinUrl)
+			healthChecker.Register("zipkin", zipkinMonitor.Checker(1000, 30*time.Second), false)
+		}
+	}
+
+	var auditor *audit.Auditor
+	if *auditFile != "" {
+		sink, err := audit.NewFileSink(*auditFile, *auditSize<<20, *auditKeep)
+		if err != nil {
+			logger.Log("error", err)
+			os.Exit(1)
+		}
+		auditor, err = audit.New(sink)
+		if err != nil {
+			logger.Log("error", err)
+			os.Exit(1)
 		}
+		defer auditor.Close()
+	}
+	proxies, err := ParseTrustedProxies(*auditProxy)
+	if err != nil {
+		logger.Log("error", err)
+		os.Exit(1)
 	}
 
-	svc := NewBizService()
+	svc := NewBizService(healthChecker)
 
-	svc = NewLoggingMiddleware(logger)(svc)
+	sampler := NewLogSampler(*logFirst, *logThen, *logSlow, logDropped)
+	svc = NewLoggingMiddleware(logger, sampler)(svc)
 
 	svc = NewMetrics(requestCount, requestLatency)(svc)
 
 	rateBucket := rate.NewLimiter(rate.Every(time.Second*1), 100)
+	// a saturated limiter only degrades readiness: failing it would take a
+	// busy instance out of rotation and deregister it
+	healthChecker.Register("limiter", health.LimiterChecker(rateBucket, 0.1), false)
 
 	bizEndpoint := MakeBizEndpoint(svc)
 
@@ -96,14 +165,18 @@ func main() {
 
 	bizEndpoint = NewTokenBucketLimiterWithBuildIn(rateBucket)(bizEndpoint)
 	bizEndpoint = kitZipkin.TraceEndpoint(zipKinTracer, "biz-endpoint")(bizEndpoint)
-	bizEndpoint = kitJwt.NewParser(JwtKeyFunc, jwt.SigningMethodHS256, kitJwt.StandardClaimsFactory)(bizEndpoint)
+	bizEndpoint = NewCallAuditMiddleware(auditor, proxies, logger)(bizEndpoint)
+	bizEndpoint = NewAccessLogUser()(bizEndpoint)
+	bizEndpoint = kitJwt.NewParser(JwtKeyFunc, jwt.SigningMethodHS256, BizClaimsFactory)(bizEndpoint)
 
+	// health checks don't take tokens from the limiter they report on
 	healthEndpoint := MakeHealthEndpoint(svc)
-	healthEndpoint = NewTokenBucketLimiterWithBuildIn(rateBucket)(healthEndpoint)
 	healthEndpoint = kitZipkin.TraceEndpoint(zipKinTracer, "health-endpoint")(healthEndpoint)
 
+	// rate limited logins are audited too, they are what brute force looks like
 	authEndpoint := MakeAuthEndpoint(svc)
 	authEndpoint = NewTokenBucketLimiterWithBuildIn(rateBucket)(authEndpoint)
+	authEndpoint = NewLoginAuditMiddleware(auditor, proxies, logger)(authEndpoint)
 	authEndpoint = kitZipkin.TraceEndpoint(zipKinTracer, "login-endpoint")(authEndpoint)
 
 	endpoints := BizEndpoints{
@@ -112,15 +185,84 @@ func main() {
 		AuthEndpoint:   authEndpoint,
 	}
 
-	r := MakeHttpHandler(ctx, endpoints, zipKinTracer, logger)
+	idempotent := idempotency.NewMemoryStore(*idemTTL, *idemKeys)
+	defer idempotent.Stop()
+
+	r := MakeHttpHandler(ctx, endpoints, healthChecker, idempotent, zipKinTracer, logger)
 
-	registrar := Register(*consulHost, *consulPort, *serviceHost, *servicePort, logger)
+	if *accessLog != "" {
+		accessLogger, err := accesslog.NewLogger(os.Stdout, *accessLog)
+		if err != nil {
+			logger.Log("error", err)
+			os.Exit(1)
+		}
+		r = accesslog.Middleware(accessLogger)(r)
+	}
+
+	checkCfg := CheckConfig{
+		Mode:            *checkMode,
+		Interval:        10 * time.Second,
+		TTL:             *checkTTL,
+		DeregisterAfter: *deregAfter,
+		HTTPS:           *tlsCert != "",
+	}
+	if err := checkCfg.Validate(); err != nil {
+		logger.Log("error", err)
+		os.Exit(1)
+	}
+	svcCfg := ServiceConfig{
+		ID:     *serviceID,
+		Name:   *svcName,
+		Host:   *serviceHost,
+		Port:   *servicePort,
+		Tags:   ParseTags(*serviceTags),
+		Weight: *svcWeight,
+		Zone:   *svcZone,
+	}
+	if *registryUrl == "" {
+		*registryUrl = "consul://" + *consulHost + ":" + *consulPort
+	}
+	reg, err := registry.New(*registryUrl)
+	if err != nil {
+		logger.Log("create registry error:", err)
+		os.Exit(1)
+	}
+	healthChecker.Register("registry", health.RegistryChecker(reg, svcCfg.Name), false)
+	registrar := NewRegistrar(reg, svcCfg, checkCfg, svc.HealthCheck, logger)
+
+	server := &http.Server{
+		Addr:    ":" + *servicePort,
+		Handler: r,
+	}
+	if *tlsCert != "" {
+		if *tlsClient == tlsconfig.ClientAuthRequire && *checkMode == CheckModeHTTP {
+			logger.Log("error", ErrCheckClientCert)
+			os.Exit(1)
+		}
+		certs, err := tlsconfig.New(tlsconfig.Files{Cert: *tlsCert, Key: *tlsKey, CA: *tlsCA}, logger)
+		if err != nil {
+			logger.Log("error", err)
+			os.Exit(1)
+		}
+		server.TLSConfig, err = certs.ServerConfig(*tlsClient)
+		if err != nil {
+			logger.Log("error", err)
+			os.Exit(1)
+		}
+	}
 
 	go func() {
 		fmt.Println("http server start at port:" + *servicePort)
 		registrar.Register()
-		handler := r
-		errChan <- http.ListenAndServe(":"+*servicePort, handler)
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			errChan <- err
+		}
 	}()
 
 	go func() {
@@ -130,6 +272,17 @@ func main() {
 	}()
 
 	error := <-errChan
+
+	healthChecker.Shutdown()
+	registrar.Maintenance("shutting down: " + error.Error())
+	time.Sleep(*drainWait)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTTL)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Log("shutdown", "drain", "error", err)
+	}
+
 	registrar.Deregister()
 	fmt.Printf("service stop:%v\n", error)
 }
@@ -1,47 +1,225 @@
 package main
 
 import (
+	"errors"
 	"github.com/go-kit/kit/log"
-	"github.com/go-kit/kit/sd"
-	"github.com/go-kit/kit/sd/consul"
-	"github.com/hashicorp/consul/api"
-	"github.com/pborman/uuid"
+	"go-kit-one/pkg/registry"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-func Register(consulHost, consulPort, svcHost, svcPort string, logger log.Logger) (registrar sd.Registrar) {
-	var client consul.Client
-	{
-		consulCfg := api.DefaultConfig()
-		consulCfg.Address = consulHost + ":" + consulPort
-		consultClient, err := api.NewClient(consulCfg)
-		if err != nil {
-			logger.Log("create consul error:", err)
-			os.Exit(1)
+var (
+	// set at build time: go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse --short HEAD)"
+	version = "dev"
+	commit  = "unknown"
+
+	supportedOperations = []string{"add", "sub", "mul", "div"}
+)
+
+const (
+	MetaVersion    = "version"
+	MetaCommit     = "commit"
+	MetaOperations = "operations"
+	MetaWeight     = "weight"
+	MetaZone       = "zone"
+)
+
+type ServiceConfig struct {
+	// ID defaults to name-hostname-port so restarts keep the same identity.
+	ID     string
+	Name   string
+	Host   string
+	Port   string
+	Tags   []string
+	Weight int
+	Zone   string
+}
+
+// ParseTags reads a comma separated tag list, dropping blanks around and
+// between the tags.
+func ParseTags(s string) []string {
+	var tags []string
+	for _, tag := range strings.Split(s, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func (cfg ServiceConfig) InstanceID() string {
+	if cfg.ID != "" {
+		return cfg.ID
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = cfg.Host
+	}
+	return cfg.Name + "-" + hostname + "-" + cfg.Port
+}
+
+func (cfg ServiceConfig) Meta() map[string]string {
+	meta := map[string]string{
+		MetaVersion:    version,
+		MetaCommit:     commit,
+		MetaOperations: strings.Join(supportedOperations, ","),
+		MetaWeight:     strconv.Itoa(cfg.Weight),
+	}
+	if cfg.Zone != "" {
+		meta[MetaZone] = cfg.Zone
+	}
+	return meta
+}
+
+const (
+	CheckModeHTTP = "http"
+	CheckModeTTL  = "ttl"
+)
+
+// ErrCheckClientCert is returned for http checks of a service requiring
+// client certificates, which Consul doesn't send, so the check would never pass.
+var ErrCheckClientCert = errors.New("consul http checks send no client certificate, use -consul.check ttl with -tls.client.auth require")
+
+// ErrCheckTTL is returned for ttl checks shorter than the one second
+// granularity of Consul check and etcd lease TTLs.
+var ErrCheckTTL = errors.New("consul.check.ttl must be at least 1s in ttl mode")
+
+type CheckConfig struct {
+	// Mode is "http" for Consul polling /health, or "ttl" for the service
+	// pushing its own status before TTL runs out.
+	Mode            string
+	Interval        time.Duration
+	TTL             time.Duration
+	DeregisterAfter time.Duration
+	// HTTPS checks /health over TLS without verifying the certificate,
+	// which names the service rather than the address Consul calls.
+	HTTPS bool
+}
+
+func (c CheckConfig) Validate() error {
+	if c.Mode == CheckModeTTL && c.TTL < time.Second {
+		return ErrCheckTTL
+	}
+	return nil
+}
+
+type Registrar struct {
+	registry registry.Registry
+	instance registry.Instance
+	ttl      time.Duration
+	health   func() bool
+	logger   log.Logger
+
+	once sync.Once
+	quit chan struct{}
+}
+
+func NewRegistrar(reg registry.Registry, svcCfg ServiceConfig, checkCfg CheckConfig, health func() bool, logger log.Logger) *Registrar {
+	port, _ := strconv.Atoi(svcCfg.Port)
+
+	check := &registry.Check{
+		DeregisterAfter: checkCfg.DeregisterAfter,
+		Notes:           "consul check service health status",
+	}
+	if checkCfg.Mode == CheckModeTTL {
+		check.TTL = checkCfg.TTL
+	} else {
+		scheme := "http://"
+		if checkCfg.HTTPS {
+			scheme = "https://"
 		}
+		check.HTTP = scheme + svcCfg.Host + ":" + svcCfg.Port + "/health"
+		check.TLSSkipVerify = checkCfg.HTTPS
+		check.Interval = checkCfg.Interval
+		check.Timeout = time.Second
+	}
 
-		client = consul.NewClient(consultClient)
+	r := &Registrar{
+		registry: reg,
+		instance: registry.Instance{
+			ID:      svcCfg.InstanceID(),
+			Service: svcCfg.Name,
+			Address: svcCfg.Host,
+			Port:    port,
+			Tags:    svcCfg.Tags,
+			Meta:    svcCfg.Meta(),
+			Weight:  svcCfg.Weight,
+			Check:   check,
+		},
+		health: health,
+		logger: log.With(logger, "service", svcCfg.Name, "id", svcCfg.InstanceID()),
+		quit:   make(chan struct{}),
+	}
+	if _, ok := reg.(registry.HealthUpdater); ok && checkCfg.Mode == CheckModeTTL {
+		r.ttl = checkCfg.TTL
 	}
+	return r
+}
 
-	check := api.AgentServiceCheck{
-		HTTP:     "http://" + svcHost + ":" + svcPort + "/health",
-		Interval: "10s",
-		Timeout:  "1s",
-		Notes:    "consul check service health status",
+func (r *Registrar) Register() {
+	err := r.registry.Register(r.instance)
+	if err == registry.ErrReadOnly {
+		// file and dns registries list instances maintained elsewhere
+		r.logger.Log("action", "register", "skipped", "registry is read-only, instance is registered externally")
+		return
+	}
+	if err != nil {
+		r.logger.Log("err", err)
+		os.Exit(1)
 	}
+	r.logger.Log("action", "register")
 
-	port, _ := strconv.Atoi(svcPort)
+	if r.ttl > 0 {
+		r.heartbeat()
+		go r.loop()
+	}
+}
+
+func (r *Registrar) loop() {
+	ticker := time.NewTicker(r.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.heartbeat()
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+func (r *Registrar) heartbeat() {
+	passing, output := true, "service is healthy"
+	if r.health != nil && !r.health() {
+		passing, output = false, "service reported unhealthy"
+	}
+	if err := r.registry.(registry.HealthUpdater).UpdateHealth(r.instance, passing, output); err != nil {
+		r.logger.Log("action", "heartbeat", "err", err)
+	}
+}
 
-	reg := api.AgentServiceRegistration{
-		ID:      "biz-" + uuid.New(),
-		Name:    "biz",
-		Address: svcHost,
-		Port:    port,
-		Tags:    []string{"biz", "vc"},
-		Check:   &check,
+// Maintenance takes the instance out of rotation, where the backend supports
+// it, so no new requests arrive while in-flight ones drain.
+func (r *Registrar) Maintenance(reason string) {
+	m, ok := r.registry.(registry.Maintainer)
+	if !ok {
+		return
 	}
+	if err := m.Maintenance(r.instance, true, reason); err != nil {
+		r.logger.Log("action", "maintenance", "err", err)
+	}
+}
 
-	registrar = consul.NewRegistrar(client, &reg, logger)
-	return
+func (r *Registrar) Deregister() {
+	r.once.Do(func() { close(r.quit) })
+	if err := r.registry.Deregister(r.instance); err == registry.ErrReadOnly {
+		return
+	} else if err != nil {
+		r.logger.Log("action", "deregister", "err", err)
+		return
+	}
+	r.logger.Log("action", "deregister")
 }
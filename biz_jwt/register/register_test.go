@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTags(t *testing.T) {
+	for in, want := range map[string][]string{
+		"":            nil,
+		" , ":         nil,
+		"biz,vc":      {"biz", "vc"},
+		" biz , vc, ": {"biz", "vc"},
+	} {
+		if got := ParseTags(in); !reflect.DeepEqual(got, want) {
+			t.Errorf("ParseTags(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestCheckConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		cfg  CheckConfig
+		want error
+	}{
+		{CheckConfig{Mode: CheckModeTTL, TTL: 15 * time.Second}, nil},
+		{CheckConfig{Mode: CheckModeTTL, TTL: time.Second}, nil},
+		{CheckConfig{Mode: CheckModeTTL}, ErrCheckTTL},
+		{CheckConfig{Mode: CheckModeTTL, TTL: 2}, ErrCheckTTL},
+		{CheckConfig{Mode: CheckModeTTL, TTL: 500 * time.Millisecond}, ErrCheckTTL},
+		// the ttl isn't used by http checks
+		{CheckConfig{Mode: CheckModeHTTP}, nil},
+	} {
+		if err := tc.cfg.Validate(); err != tc.want {
+			t.Errorf("%s check with ttl %v: %v, want %v", tc.cfg.Mode, tc.cfg.TTL, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/go-kit/kit/metrics"
+	"sync"
+	"time"
+)
+
+// LogSampler logs the first `first` calls per key in every second and then
+// one in `thereafter`. Errors and calls slower than `slow` are always logged.
+type LogSampler struct {
+	first      uint64
+	thereafter uint64
+	slow       time.Duration
+	dropped    metrics.Counter
+
+	mtx    sync.Mutex
+	counts map[string]*sampleCount
+}
+
+type sampleCount struct {
+	resetAt time.Time
+	n       uint64
+}
+
+func NewLogSampler(first, thereafter int, slow time.Duration, dropped metrics.Counter) *LogSampler {
+	if first <= 0 {
+		return nil
+	}
+	if thereafter < 0 {
+		thereafter = 0
+	}
+	return &LogSampler{
+		first:      uint64(first),
+		thereafter: uint64(thereafter),
+		slow:       slow,
+		dropped:    dropped,
+		counts:     make(map[string]*sampleCount),
+	}
+}
+
+func (s *LogSampler) Sample(key string, cost time.Duration, err error) bool {
+	if s == nil || err != nil || (s.slow > 0 && cost >= s.slow) {
+		return true
+	}
+
+	now := time.Now()
+	s.mtx.Lock()
+	c, ok := s.counts[key]
+	if !ok {
+		c = &sampleCount{}
+		s.counts[key] = c
+	}
+	if now.After(c.resetAt) {
+		c.resetAt = now.Add(time.Second)
+		c.n = 0
+	}
+	c.n++
+	n := c.n
+	s.mtx.Unlock()
+
+	if n <= s.first || (s.thereafter > 0 && (n-s.first)%s.thereafter == 0) {
+		return true
+	}
+	if s.dropped != nil {
+		s.dropped.With("method", key).Add(1)
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"github.com/go-kit/kit/metrics"
+	"sync"
+	"testing"
+	"time"
+)
+
+// droppedCounter counts drops per method label.
+type droppedCounter struct {
+	mtx    sync.Mutex
+	counts map[string]float64
+	method string
+}
+
+func (c *droppedCounter) With(labelValues ...string) metrics.Counter {
+	for i := 0; i+1 < len(labelValues); i += 2 {
+		if labelValues[i] == "method" {
+			return &droppedCounter{counts: c.counts, method: labelValues[i+1]}
+		}
+	}
+	return c
+}
+
+func (c *droppedCounter) Add(delta float64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.counts[c.method] += delta
+}
+
+func TestLogSampler(t *testing.T) {
+	dropped := &droppedCounter{counts: make(map[string]float64)}
+	s := NewLogSampler(2, 3, 100*time.Millisecond, dropped)
+
+	var logged []int
+	for i := 1; i <= 11; i++ {
+		if s.Sample("Add", time.Millisecond, nil) {
+			logged = append(logged, i)
+		}
+	}
+	// the first 2, then every 3rd after them
+	want := []int{1, 2, 5, 8, 11}
+	if len(logged) != len(want) {
+		t.Fatalf("logged calls %v, want %v", logged, want)
+	}
+	for i := range want {
+		if logged[i] != want[i] {
+			t.Fatalf("logged calls %v, want %v", logged, want)
+		}
+	}
+	if dropped.counts["Add"] != 6 {
+		t.Fatalf("dropped %v, want 6", dropped.counts["Add"])
+	}
+
+	if !s.Sample("Add", time.Millisecond, errors.New("boom")) {
+		t.Fatal("error not logged")
+	}
+	if !s.Sample("Add", 100*time.Millisecond, nil) {
+		t.Fatal("slow call not logged")
+	}
+	// keys are sampled independently
+	if !s.Sample("Login", time.Millisecond, nil) {
+		t.Fatal("first call of another method not logged")
+	}
+}
+
+func TestLogSamplerResetsEverySecond(t *testing.T) {
+	s := NewLogSampler(1, 0, 0, nil)
+	if !s.Sample("Add", 0, nil) || s.Sample("Add", 0, nil) {
+		t.Fatal("sampler logged more than the first call")
+	}
+	s.counts["Add"].resetAt = time.Now().Add(-time.Millisecond)
+	if !s.Sample("Add", 0, nil) {
+		t.Fatal("first call of the next second not logged")
+	}
+}
+
+func TestLogSamplerDisabled(t *testing.T) {
+	s := NewLogSampler(0, 10, 0, nil)
+	for i := 0; i < 10; i++ {
+		if !s.Sample("Add", 0, nil) {
+			t.Fatal("disabled sampler dropped a call")
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"go-kit-one/pkg/health"
 )
 
 type Service interface {
@@ -19,10 +21,11 @@ type Service interface {
 }
 
 type BizService struct {
+	health *health.Health
 }
 
-func NewBizService() Service {
-	return &BizService{}
+func NewBizService(h *health.Health) Service {
+	return &BizService{health: h}
 }
 
 func (s *BizService) Add(a, b int) int {
@@ -45,7 +48,10 @@ func (s *BizService) Div(a, b int) (int, error) {
 }
 
 func (s *BizService) HealthCheck() bool {
-	return true
+	if s.health == nil {
+		return true
+	}
+	return s.health.Ready(context.Background())
 }
 
 func (s *BizService) Login(name, pwd string) (string, error) {
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/dgrijalva/jwt-go"
 	kitJwt "github.com/go-kit/kit/auth/jwt"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/tracing/zipkin"
@@ -12,6 +13,9 @@ import (
 	"github.com/gorilla/mux"
 	goZipkin "github.com/openzipkin/zipkin-go"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go-kit-one/pkg/accesslog"
+	"go-kit-one/pkg/health"
+	"go-kit-one/pkg/idempotency"
 	"net/http"
 	"strconv"
 )
@@ -20,33 +24,39 @@ var (
 	ErrBadRequest = errors.New("invalid request parameter")
 )
 
-func MakeHttpHandler(ctx context.Context, endpoints BizEndpoints, tracer *goZipkin.Tracer, logger log.Logger) http.Handler {
+func MakeHttpHandler(ctx context.Context, endpoints BizEndpoints, h *health.Health, idempotent idempotency.Store, tracer *goZipkin.Tracer, logger log.Logger) http.Handler {
 	r := mux.NewRouter()
+	r.Use(accesslog.MuxRoute)
 
 	zipkinServer := zipkin.HTTPServerTrace(tracer, zipkin.Name("http-transport"))
 
 	options := []kitHttp.ServerOption{
 		kitHttp.ServerErrorLogger(logger),
-		kitHttp.ServerErrorEncoder(kitHttp.DefaultErrorEncoder),
+		kitHttp.ServerErrorEncoder(encodeError),
+		kitHttp.ServerBefore(kitHttp.PopulateRequestContext),
 		zipkinServer,
 	}
 
-	r.Methods("POST").Path("/biz/{type}/{a}/{b}").Handler(kitHttp.NewServer(
+	// biz calls are POST, an Idempotency-Key makes them safe to retry
+	r.Methods("POST").Path("/biz/{type}/{a}/{b}").Handler(idempotency.Middleware(idempotent, logger)(kitHttp.NewServer(
 		endpoints.BizEndpoint,
 		decodeBizRequest,
 		encodeBizResponse,
 		append(options, kitHttp.ServerBefore(kitJwt.HTTPToContext()))...,
-	))
+	)))
 
 	r.Path("/metrics").Handler(promhttp.Handler())
 
 	r.Methods("GET").Path("/health").Handler(kitHttp.NewServer(
 		endpoints.HealthEndpoint,
 		decodeHealthRequest,
-		encodeBizResponse,
+		encodeHealthResponse,
 		options...,
 	))
 
+	r.Methods("GET").Path("/health/live").Handler(h.LivenessHandler())
+	r.Methods("GET").Path("/health/ready").Handler(h.ReadinessHandler())
+
 	r.Methods("POST").Path("/login").Handler(kitHttp.NewServer(
 		endpoints.AuthEndpoint,
 		decodeLoginRequest,
@@ -57,6 +67,28 @@ func MakeHttpHandler(ctx context.Context, endpoints BizEndpoints, tracer *goZipk
 	return r
 }
 
+// encodeError answers token errors with 401, so clients know to log in
+// again instead of retrying, and rejected requests with 400 or 429; anything
+// else is a 500 as with kitHttp.DefaultErrorEncoder.
+func encodeError(ctx context.Context, err error, w http.ResponseWriter) {
+	code := http.StatusInternalServerError
+	var validation *jwt.ValidationError
+	switch {
+	case err == kitJwt.ErrTokenContextMissing, err == kitJwt.ErrTokenInvalid, err == kitJwt.ErrTokenExpired,
+		err == kitJwt.ErrTokenMalformed, err == kitJwt.ErrTokenNotActive, err == kitJwt.ErrUnexpectedSigningMethod,
+		errors.As(err, &validation):
+		code = http.StatusUnauthorized
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	case err == ErrLimitExceed:
+		code = http.StatusTooManyRequests
+	case err == ErrBadRequest, err == ErrInvalidType:
+		code = http.StatusBadRequest
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write([]byte(err.Error()))
+}
+
 func decodeBizRequest(ctx context.Context, r *http.Request) (interface{}, error) {
 	vars := mux.Vars(r)
 	fmt.Printf("vars:%v\n", vars)
@@ -93,6 +125,14 @@ func decodeHealthRequest(ctx context.Context, r *http.Request) (interface{}, err
 	return &HealthRequest{}, nil
 }
 
+func encodeHealthResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	if res, ok := response.(*HealthResponse); ok && !res.Status {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return json.NewEncoder(w).Encode(response)
+}
+
 func encodeLoginResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 	return json.NewEncoder(w).Encode(response)
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"go-kit-one/pkg/consulfake"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+var (
+	addr = flag.String("addr", "127.0.0.1:8500", "listen address of the fake consul agent")
+)
+
+func main() {
+	flag.Parse()
+
+	var logger log.Logger
+	{
+		logger = log.NewLogfmtLogger(os.Stderr)
+		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
+		logger = log.With(logger, "caller", log.DefaultCaller)
+	}
+
+	fake, err := consulfake.Start(*addr)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+	defer fake.Close()
+	logger.Log("transport", "http", "addr", fake.Addr())
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	logger.Log("exit", fmt.Sprintf("%s", <-c))
+}
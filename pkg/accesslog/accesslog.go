@@ -0,0 +1,287 @@
+package accesslog
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FormatCommon   = "common"
+	FormatCombined = "combined"
+	// FormatExtended is combined followed by the route, upstream, request id
+	// and latency, which the standard formats have no place for.
+	FormatExtended = "extended"
+	FormatJSON     = "json"
+
+	RequestIDHeader = "X-Request-Id"
+)
+
+var (
+	ErrUnknownFormat = errors.New("access log format has 4 types: common, combined, extended and json")
+)
+
+type contextKey struct{}
+
+// Entry is one access log line. Handlers further down the chain fill in
+// Route, Upstream and User through the Set* helpers.
+type Entry struct {
+	Time       time.Time     `json:"time"`
+	RemoteAddr string        `json:"remote_addr"`
+	Method     string        `json:"method"`
+	Path       string        `json:"path"`
+	Proto      string        `json:"proto"`
+	Route      string        `json:"route,omitempty"`
+	Status     int           `json:"status"`
+	Bytes      int64         `json:"bytes"`
+	Latency    time.Duration `json:"-"`
+	Upstream   string        `json:"upstream,omitempty"`
+	User       string        `json:"user,omitempty"`
+	RequestID  string        `json:"request_id"`
+	Referer    string        `json:"referer,omitempty"`
+	UserAgent  string        `json:"user_agent,omitempty"`
+
+	mtx sync.Mutex
+}
+
+type Logger struct {
+	mtx    sync.Mutex
+	w      io.Writer
+	format string
+}
+
+func NewLogger(w io.Writer, format string) (*Logger, error) {
+	switch format {
+	case FormatCommon, FormatCombined, FormatExtended, FormatJSON:
+	default:
+		return nil, ErrUnknownFormat
+	}
+	return &Logger{w: w, format: format}, nil
+}
+
+func (l *Logger) Log(e *Entry) error {
+	var line []byte
+	if l.format == FormatJSON {
+		e.mtx.Lock()
+		b, err := json.Marshal(struct {
+			*Entry
+			LatencyMs float64 `json:"latency_ms"`
+		}{e, float64(e.Latency) / float64(time.Millisecond)})
+		e.mtx.Unlock()
+		if err != nil {
+			return err
+		}
+		line = append(b, '\n')
+	} else {
+		line = []byte(l.clf(e))
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	_, err := l.w.Write(line)
+	return err
+}
+
+func (l *Logger) clf(e *Entry) string {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	host, _, err := net.SplitHostPort(e.RemoteAddr)
+	if err != nil {
+		host = e.RemoteAddr
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s - %s [%s] \"%s %s %s\" %d %s",
+		dash(host),
+		dash(e.User),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, e.Path, e.Proto,
+		e.Status,
+		dash(bytesField(e.Bytes)),
+	)
+	if l.format != FormatCommon {
+		fmt.Fprintf(&sb, " %q %q", dash(e.Referer), dash(e.UserAgent))
+	}
+	if l.format == FormatExtended {
+		fmt.Fprintf(&sb, " route=%s upstream=%s request_id=%s latency=%s",
+			dash(e.Route), dash(e.Upstream), dash(e.RequestID), e.Latency)
+	}
+	sb.WriteByte('\n')
+	return sb.String()
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func bytesField(n int64) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// Middleware logs every request passing through next. A request id is taken
+// from the X-Request-Id header or generated, and forwarded both upstream and
+// back to the client.
+func Middleware(l *Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			begin := time.Now()
+
+			reqID := r.Header.Get(RequestIDHeader)
+			if reqID == "" {
+				reqID = uuid.New().String()
+				r.Header.Set(RequestIDHeader, reqID)
+			}
+			w.Header().Set(RequestIDHeader, reqID)
+
+			e := &Entry{
+				Time:       begin,
+				RemoteAddr: r.RemoteAddr,
+				Method:     r.Method,
+				Path:       r.URL.RequestURI(),
+				Proto:      r.Proto,
+				RequestID:  reqID,
+				Referer:    r.Referer(),
+				UserAgent:  r.UserAgent(),
+			}
+			if r.URL.User != nil {
+				e.User = r.URL.User.Username()
+			}
+
+			rw := NewResponseWriter(w)
+			ctx := context.WithValue(r.Context(), contextKey{}, e)
+
+			defer func() {
+				e.mtx.Lock()
+				e.Status = rw.Status()
+				e.Bytes = rw.Bytes()
+				e.Latency = time.Since(begin)
+				e.mtx.Unlock()
+				l.Log(e)
+			}()
+
+			next.ServeHTTP(rw, r.WithContext(ctx))
+		})
+	}
+}
+
+// MuxRoute records the matched gorilla/mux path template. Install it with
+// Router.Use so it runs after route matching.
+func MuxRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if tpl, err := route.GetPathTemplate(); err == nil {
+				SetRoute(r.Context(), tpl)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func FromContext(ctx context.Context) (*Entry, bool) {
+	e, ok := ctx.Value(contextKey{}).(*Entry)
+	return e, ok
+}
+
+func RequestID(ctx context.Context) string {
+	if e, ok := FromContext(ctx); ok {
+		return e.RequestID
+	}
+	return ""
+}
+
+func SetRoute(ctx context.Context, route string) {
+	if e, ok := FromContext(ctx); ok {
+		e.mtx.Lock()
+		e.Route = route
+		e.mtx.Unlock()
+	}
+}
+
+func SetUpstream(ctx context.Context, upstream string) {
+	if e, ok := FromContext(ctx); ok {
+		e.mtx.Lock()
+		e.Upstream = upstream
+		e.mtx.Unlock()
+	}
+}
+
+func SetUser(ctx context.Context, user string) {
+	if e, ok := FromContext(ctx); ok {
+		e.mtx.Lock()
+		e.User = user
+		e.mtx.Unlock()
+	}
+}
+
+// ResponseWriter records the status code and body size written through it.
+type ResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func NewResponseWriter(w http.ResponseWriter) *ResponseWriter {
+	return &ResponseWriter{ResponseWriter: w}
+}
+
+func (rw *ResponseWriter) WriteHeader(code int) {
+	if rw.status == 0 {
+		rw.status = code
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *ResponseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += int64(n)
+	return n, err
+}
+
+func (rw *ResponseWriter) Status() int {
+	if rw.status == 0 {
+		return http.StatusOK
+	}
+	return rw.status
+}
+
+func (rw *ResponseWriter) Bytes() int64 {
+	return rw.bytes
+}
+
+func (rw *ResponseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	if rw.status == 0 {
+		rw.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
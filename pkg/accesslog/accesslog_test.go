@@ -0,0 +1,60 @@
+package accesslog
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestLoggerFormats(t *testing.T) {
+	e := &Entry{
+		Time:       time.Date(2019, time.September, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600)),
+		RemoteAddr: "127.0.0.1:52000",
+		Method:     "GET",
+		Path:       "/calc/add?a=1&b=2",
+		Proto:      "HTTP/1.1",
+		Route:      "/calc/",
+		Status:     200,
+		Bytes:      2326,
+		Latency:    1500 * time.Microsecond,
+		Upstream:   "127.0.0.1:8000",
+		User:       "frank",
+		RequestID:  "abc",
+		Referer:    "http://www.example.com/start.html",
+		UserAgent:  "Mozilla/4.08",
+	}
+	for _, tc := range []struct {
+		format string
+		want   string
+	}{
+		{FormatCommon, `127.0.0.1 - frank [10/Sep/2019:13:55:36 -0700] "GET /calc/add?a=1&b=2 HTTP/1.1" 200 2326` + "\n"},
+		{FormatCombined, `127.0.0.1 - frank [10/Sep/2019:13:55:36 -0700] "GET /calc/add?a=1&b=2 HTTP/1.1" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08"` + "\n"},
+		{FormatExtended, `127.0.0.1 - frank [10/Sep/2019:13:55:36 -0700] "GET /calc/add?a=1&b=2 HTTP/1.1" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08" route=/calc/ upstream=127.0.0.1:8000 request_id=abc latency=1.5ms` + "\n"},
+	} {
+		var buf bytes.Buffer
+		l, err := NewLogger(&buf, tc.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Log(e); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != tc.want {
+			t.Errorf("%s:\n got %q\nwant %q", tc.format, got, tc.want)
+		}
+	}
+
+	if _, err := NewLogger(&bytes.Buffer{}, "clf"); err != ErrUnknownFormat {
+		t.Fatalf("unknown format: %v", err)
+	}
+}
+
+func TestLoggerEmptyFields(t *testing.T) {
+	var buf bytes.Buffer
+	l, _ := NewLogger(&buf, FormatCombined)
+	l.Log(&Entry{Time: time.Unix(0, 0).UTC(), RemoteAddr: "10.0.0.1", Method: "GET", Path: "/", Proto: "HTTP/1.1", Status: 304})
+	want := `10.0.0.1 - - [01/Jan/1970:00:00:00 +0000] "GET / HTTP/1.1" 304 - "-" "-"` + "\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("got %q\nwant %q", got, want)
+	}
+}
@@ -0,0 +1,153 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	TypeLoginSuccess = "login.success"
+	TypeLoginFailure = "login.failure"
+	TypeTokenIssued  = "token.issued"
+	TypeCall         = "call"
+)
+
+var (
+	ErrBrokenChain = errors.New("audit log hash chain is broken")
+)
+
+// Event is one audit record. Seq, Time, PrevHash and Hash are filled in by
+// the Auditor; Hash covers every other field plus PrevHash, so editing or
+// dropping a line breaks the chain from that point on.
+type Event struct {
+	Seq       uint64                 `json:"seq"`
+	Time      time.Time              `json:"time"`
+	Type      string                 `json:"type"`
+	User      string                 `json:"user,omitempty"`
+	SourceIP  string                 `json:"source_ip,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+	Operation string                 `json:"operation,omitempty"`
+	Claims    map[string]interface{} `json:"claims,omitempty"`
+	Detail    string                 `json:"detail,omitempty"`
+	PrevHash  string                 `json:"prev_hash"`
+	Hash      string                 `json:"hash"`
+}
+
+// Sink stores serialized events. Implementations must only ever append.
+type Sink interface {
+	Write(line []byte) error
+	Close() error
+}
+
+// Tailer is implemented by sinks that can hand back the last stored line so
+// a restarted Auditor continues the existing chain.
+type Tailer interface {
+	Tail() ([]byte, error)
+}
+
+type Auditor struct {
+	mtx      sync.Mutex
+	sink     Sink
+	seq      uint64
+	lastHash string
+}
+
+func New(sink Sink) (*Auditor, error) {
+	a := &Auditor{sink: sink}
+	if t, ok := sink.(Tailer); ok {
+		line, err := t.Tail()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) > 0 {
+			var last Event
+			if err := json.Unmarshal(line, &last); err != nil {
+				return nil, fmt.Errorf("audit: resume chain: %v", err)
+			}
+			a.seq = last.Seq
+			a.lastHash = last.Hash
+		}
+	}
+	return a, nil
+}
+
+func (a *Auditor) Record(e Event) error {
+	if a == nil {
+		return nil
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	e.Seq = a.seq + 1
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	e.PrevHash = a.lastHash
+	hash, err := eventHash(e)
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := a.sink.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	a.seq = e.Seq
+	a.lastHash = e.Hash
+	return nil
+}
+
+func (a *Auditor) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.sink.Close()
+}
+
+func eventHash(e Event) (string, error) {
+	e.Hash = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Verify reads JSON lines from r and checks every hash and link. prevHash is
+// the hash preceding the first line, empty for the very first log file.
+func Verify(r io.Reader, prevHash string) (lastHash string, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return prevHash, err
+		}
+		if e.PrevHash != prevHash {
+			return prevHash, fmt.Errorf("%w: seq %d does not link to previous record", ErrBrokenChain, e.Seq)
+		}
+		hash, err := eventHash(e)
+		if err != nil {
+			return prevHash, err
+		}
+		if hash != e.Hash {
+			return prevHash, fmt.Errorf("%w: seq %d was modified", ErrBrokenChain, e.Seq)
+		}
+		prevHash = e.Hash
+	}
+	return prevHash, scanner.Err()
+}
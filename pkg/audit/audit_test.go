@@ -0,0 +1,92 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type bufferSink struct {
+	bytes.Buffer
+}
+
+func (s *bufferSink) Write(line []byte) error {
+	_, err := s.Buffer.Write(line)
+	return err
+}
+
+func (s *bufferSink) Close() error { return nil }
+
+func recordLines(t *testing.T, n int) []string {
+	sink := &bufferSink{}
+	a, err := New(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := a.Record(Event{Type: TypeCall, User: "admin", Operation: "add"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return strings.SplitAfter(strings.TrimSuffix(sink.String(), "\n"), "\n")
+}
+
+func TestVerify(t *testing.T) {
+	lines := recordLines(t, 4)
+	if _, err := Verify(strings.NewReader(strings.Join(lines, "")), ""); err != nil {
+		t.Fatalf("intact log: %v", err)
+	}
+
+	modified := append([]string(nil), lines...)
+	modified[1] = strings.Replace(modified[1], `"user":"admin"`, `"user":"guest"`, 1)
+	if _, err := Verify(strings.NewReader(strings.Join(modified, "")), ""); !errors.Is(err, ErrBrokenChain) {
+		t.Fatalf("modified line: %v", err)
+	}
+
+	removed := append(append([]string(nil), lines[:2]...), lines[3:]...)
+	if _, err := Verify(strings.NewReader(strings.Join(removed, "")), ""); !errors.Is(err, ErrBrokenChain) {
+		t.Fatalf("removed line: %v", err)
+	}
+
+	if _, err := Verify(strings.NewReader(strings.Join(lines[1:], "")), ""); !errors.Is(err, ErrBrokenChain) {
+		t.Fatalf("removed first line: %v", err)
+	}
+}
+
+func TestAuditorResumesChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for i := 0; i < 2; i++ {
+		sink, err := NewFileSink(path, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := New(sink)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Record(Event{Type: TypeLoginSuccess, User: "admin"}); err != nil {
+			t.Fatal(err)
+		}
+		a.Close()
+	}
+
+	sink, err := NewFileSink(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	tail, _ := sink.Tail()
+	if !bytes.Contains(tail, []byte(`"seq":2`)) {
+		t.Fatalf("tail after restart: %s", tail)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(bytes.NewReader(b), ""); err != nil {
+		t.Fatalf("chain across restarts: %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package audit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// FileSink appends events to a file and rotates it to path.1, path.2, ...
+// once it grows past maxBytes. Rotated files are never rewritten.
+type FileSink struct {
+	mtx        sync.Mutex
+	path       string
+	maxBytes   int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func NewFileSink(path string, maxBytes int64, maxBackups int) (*FileSink, error) {
+	s := &FileSink{
+		path:       path,
+		maxBytes:   maxBytes,
+		maxBackups: maxBackups,
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file = f
+	s.size = info.Size()
+	return nil
+}
+
+func (s *FileSink) Write(line []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.maxBytes > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	// maxBackups <= 0 keeps every rotated file.
+	n := s.maxBackups
+	if n <= 0 {
+		for n = 1; ; n++ {
+			if _, err := os.Stat(s.backup(n)); os.IsNotExist(err) {
+				break
+			}
+		}
+	} else {
+		os.Remove(s.backup(n))
+	}
+	for i := n - 1; i >= 1; i-- {
+		if err := os.Rename(s.backup(i), s.backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(s.path, s.backup(1)); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *FileSink) backup(i int) string {
+	return fmt.Sprintf("%s.%d", s.path, i)
+}
+
+// Tail returns the last line written, looking at the newest backup when the
+// current file is still empty right after a rotation.
+func (s *FileSink) Tail() ([]byte, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, p := range []string{s.path, s.backup(1)} {
+		line, err := lastLine(p)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(line) > 0 {
+			return line, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *FileSink) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.file.Close()
+}
+
+func lastLine(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	const chunk = 4096
+	var (
+		buf []byte
+		off = info.Size()
+	)
+	for off > 0 {
+		n := int64(chunk)
+		if off < n {
+			n = off
+		}
+		off -= n
+		b := make([]byte, n)
+		if _, err := f.ReadAt(b, off); err != nil && err != io.EOF {
+			return nil, err
+		}
+		buf = append(b, buf...)
+		trimmed := bytes.TrimRight(buf, "\n")
+		if i := bytes.LastIndexByte(trimmed, '\n'); i >= 0 {
+			return trimmed[i+1:], nil
+		}
+	}
+	return bytes.TrimRight(buf, "\n"), nil
+}
+
+// WriterSink sends events to any writer, e.g. os.Stdout or a log shipper.
+type WriterSink struct {
+	mtx sync.Mutex
+	w   io.Writer
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+func (s *WriterSink) Write(line []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	_, err := s.w.Write(line)
+	return err
+}
+
+func (s *WriterSink) Close() error {
+	if c, ok := s.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-kit-one/pkg/registry"
+	"strconv"
+	"strings"
+)
+
+const (
+	RoundRobin   = "round_robin"
+	Random       = "random"
+	Weighted     = "weighted"
+	LeastRequest = "least_request"
+	P2C          = "p2c"
+	Hash         = "hash"
+)
+
+var (
+	ErrNoInstances     = errors.New("no instances available")
+	ErrUnknownStrategy = errors.New("balancer has 6 strategies: round_robin, random, weighted, least_request, p2c and hash")
+)
+
+// Done must be called once the request picked by a Balancer has finished,
+// with the error it ended with, so load and latency stats stay accurate.
+type Done func(err error)
+
+type Balancer interface {
+	Pick(ctx context.Context, instances []registry.Instance) (registry.Instance, Done, error)
+}
+
+// New builds a balancer for strategy. A non-empty zone wraps it so that
+// instances in the same zone are preferred whenever there are any.
+func New(strategy, zone string) (Balancer, error) {
+	var b Balancer
+	switch strategy {
+	case RoundRobin, "":
+		b = NewRoundRobin()
+	case Random:
+		b = NewRandom()
+	case Weighted:
+		b = NewWeighted()
+	case LeastRequest:
+		b = NewLeastRequest()
+	case P2C:
+		b = NewP2C()
+	case Hash:
+		b = NewConsistentHash()
+	default:
+		return nil, fmt.Errorf("%v: %q", ErrUnknownStrategy, strategy)
+	}
+	if zone != "" {
+		b = NewZoneAware(zone, b)
+	}
+	return b, nil
+}
+
+// ParseStrategies parses "biz=p2c,auth=weighted" into a service -> strategy
+// map. An entry without "=" sets the default strategy under the "*" key.
+func ParseStrategies(s string) (map[string]string, error) {
+	strategies := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		service, strategy := "*", part
+		if i := strings.Index(part, "="); i >= 0 {
+			service, strategy = strings.TrimSpace(part[:i]), strings.TrimSpace(part[i+1:])
+		}
+		if _, err := New(strategy, ""); err != nil {
+			return nil, err
+		}
+		strategies[service] = strategy
+	}
+	return strategies, nil
+}
+
+// Weight reads the routing weight of an instance from its "weight" metadata,
+// falling back to the registry weight and finally to 1.
+func Weight(inst registry.Instance) int {
+	if w, err := strconv.Atoi(inst.Meta["weight"]); err == nil && w > 0 {
+		return w
+	}
+	if inst.Weight > 0 {
+		return inst.Weight
+	}
+	return 1
+}
+
+func noop(error) {}
@@ -0,0 +1,95 @@
+package balancer
+
+import (
+	"context"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	"github.com/go-kit/kit/sd/lb"
+	"go-kit-one/pkg/registry"
+	"io"
+	"sync"
+)
+
+// EndpointBalancer adapts a Balancer to go-kit's lb.Balancer. The instance
+// is picked when the returned endpoint is invoked, so strategies can see the
+// request context, and the result of the call is fed back through Done.
+type EndpointBalancer struct {
+	instancer *registry.Instancer
+	factory   sd.Factory
+	balancer  Balancer
+	logger    log.Logger
+
+	mtx       sync.Mutex
+	endpoints map[string]endpoint.Endpoint
+	closers   map[string]io.Closer
+}
+
+func NewEndpointBalancer(instancer *registry.Instancer, factory sd.Factory, balancer Balancer, logger log.Logger) *EndpointBalancer {
+	return &EndpointBalancer{
+		instancer: instancer,
+		factory:   factory,
+		balancer:  balancer,
+		logger:    logger,
+		endpoints: make(map[string]endpoint.Endpoint),
+		closers:   make(map[string]io.Closer),
+	}
+}
+
+func (b *EndpointBalancer) Endpoint() (endpoint.Endpoint, error) {
+	if len(b.instancer.Instances()) == 0 {
+		return nil, lb.ErrNoEndpoints
+	}
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		inst, done, err := b.balancer.Pick(ctx, b.instancer.Instances())
+		if err != nil {
+			return nil, err
+		}
+		e, err := b.endpoint(inst.HostPort())
+		if err != nil {
+			done(err)
+			return nil, err
+		}
+		response, err := e(ctx, request)
+		done(err)
+		return response, err
+	}, nil
+}
+
+func (b *EndpointBalancer) endpoint(addr string) (endpoint.Endpoint, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.prune()
+	if e, ok := b.endpoints[addr]; ok {
+		return e, nil
+	}
+	e, closer, err := b.factory(addr)
+	if err != nil {
+		b.logger.Log("instance", addr, "err", err)
+		return nil, err
+	}
+	b.endpoints[addr] = e
+	if closer != nil {
+		b.closers[addr] = closer
+	}
+	return e, nil
+}
+
+// prune drops endpoints of instances that left the registry.
+func (b *EndpointBalancer) prune() {
+	current := make(map[string]struct{})
+	for _, inst := range b.instancer.Instances() {
+		current[inst.HostPort()] = struct{}{}
+	}
+	for addr := range b.endpoints {
+		if _, ok := current[addr]; ok {
+			continue
+		}
+		if closer, ok := b.closers[addr]; ok {
+			closer.Close()
+			delete(b.closers, addr)
+		}
+		delete(b.endpoints, addr)
+	}
+}
@@ -0,0 +1,67 @@
+package balancer
+
+import "sync"
+
+// Group hands out one balancer per upstream service, built lazily from the
+// strategy configured for that service or the "*" default.
+type Group struct {
+	strategies map[string]string
+	zone       string
+	outlier    OutlierConfig
+
+	mtx       sync.Mutex
+	balancers map[string]Balancer
+	detectors map[string]*OutlierDetector
+}
+
+// NewGroup parses strategies as ParseStrategies does, e.g. "p2c,auth=weighted".
+// Every balancer gets its own outlier detector when outlier.Consecutive > 0.
+func NewGroup(strategies, zone string, outlier OutlierConfig) (*Group, error) {
+	parsed, err := ParseStrategies(strategies)
+	if err != nil {
+		return nil, err
+	}
+	return &Group{
+		strategies: parsed,
+		zone:       zone,
+		outlier:    outlier,
+		balancers:  make(map[string]Balancer),
+		detectors:  make(map[string]*OutlierDetector),
+	}, nil
+}
+
+func (g *Group) Strategy(service string) string {
+	if s, ok := g.strategies[service]; ok {
+		return s
+	}
+	if s, ok := g.strategies["*"]; ok {
+		return s
+	}
+	return RoundRobin
+}
+
+func (g *Group) Get(service string) Balancer {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if b, ok := g.balancers[service]; ok {
+		return b
+	}
+	// strategies were validated by NewGroup
+	b, _ := New(g.Strategy(service), g.zone)
+	if g.outlier.Consecutive > 0 {
+		d := NewOutlierDetector(service, g.outlier)
+		g.detectors[service] = d
+		b = NewOutlierBalancer(d, b)
+	}
+	b = avoidTried{next: b}
+	g.balancers[service] = b
+	return b
+}
+
+// Detector returns the outlier detector of service, nil when outlier
+// detection is off or the service saw no traffic yet.
+func (g *Group) Detector(service string) *OutlierDetector {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return g.detectors[service]
+}
@@ -0,0 +1,210 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"go-kit-one/pkg/registry"
+	"hash/crc32"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// replicas is the number of points each instance owns on the ring; more
+// points spread keys more evenly at the cost of a larger ring.
+const replicas = 160
+
+// maxRings bounds the rings kept per balancer. Retries, ejections and
+// version splits pick from different subsets of the instances, each with a
+// ring of its own.
+const maxRings = 16
+
+var ErrUnknownKeySource = errors.New("hash key source must be header:<name>, cookie:<name>, claim:<name> or path:<index>")
+
+type keyCtx struct{}
+
+// WithKey stores the key the consistent hash balancer routes by.
+func WithKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, keyCtx{}, key)
+}
+
+func KeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(keyCtx{}).(string)
+	return key
+}
+
+// KeySource says where the hash key of a request comes from.
+type KeySource struct {
+	Kind string
+	Name string
+}
+
+// ParseKeySource parses "header:X-User-Id", "cookie:uid", "claim:Name" or
+// "path:3". Path indexes count from strings.Split(path, "/"), so "path:1" is
+// the first segment. An empty string gives a KeySource that never yields a key.
+func ParseKeySource(s string) (KeySource, error) {
+	if s == "" {
+		return KeySource{}, nil
+	}
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return KeySource{}, fmt.Errorf("%v: %q", ErrUnknownKeySource, s)
+	}
+	src := KeySource{Kind: s[:i], Name: s[i+1:]}
+	switch src.Kind {
+	case "header", "cookie", "claim":
+	case "path":
+		if _, err := strconv.Atoi(src.Name); err != nil {
+			return KeySource{}, fmt.Errorf("%v: %q", ErrUnknownKeySource, s)
+		}
+	default:
+		return KeySource{}, fmt.Errorf("%v: %q", ErrUnknownKeySource, s)
+	}
+	return src, nil
+}
+
+func (k KeySource) Key(r *http.Request) string {
+	switch k.Kind {
+	case "header":
+		return r.Header.Get(k.Name)
+	case "cookie":
+		if c, err := r.Cookie(k.Name); err == nil {
+			return c.Value
+		}
+	case "claim":
+		return claim(r, k.Name)
+	case "path":
+		idx, _ := strconv.Atoi(k.Name)
+		segments := strings.Split(r.URL.Path, "/")
+		if idx >= 0 && idx < len(segments) {
+			return segments[idx]
+		}
+	}
+	return ""
+}
+
+// claim reads a claim from the bearer token without verifying it: the key
+// only decides which instance serves the request, the backend still checks
+// the signature.
+func claim(r *http.Request, name string) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return ""
+	}
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(auth[7:], claims); err != nil {
+		return ""
+	}
+	if v, ok := claims[name]; ok && v != nil {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// consistentHash maps the request key onto a hash ring of the instances, so
+// an instance joining or leaving only moves the keys next to its points.
+// Requests without a key are balanced round-robin.
+type consistentHash struct {
+	fallback Balancer
+
+	mtx   sync.Mutex
+	rings map[uint64]*ring
+}
+
+type ring struct {
+	hashes []uint32
+	owners []registry.Instance
+}
+
+func NewConsistentHash() Balancer {
+	return &consistentHash{fallback: NewRoundRobin(), rings: make(map[uint64]*ring)}
+}
+
+func (b *consistentHash) Pick(ctx context.Context, instances []registry.Instance) (registry.Instance, Done, error) {
+	key := KeyFromContext(ctx)
+	if key == "" || len(instances) == 0 {
+		return b.fallback.Pick(ctx, instances)
+	}
+
+	sig := signature(instances)
+	b.mtx.Lock()
+	r, ok := b.rings[sig]
+	if !ok {
+		if len(b.rings) >= maxRings {
+			for old := range b.rings {
+				delete(b.rings, old)
+				break
+			}
+		}
+		r = newRing(instances)
+		b.rings[sig] = r
+	}
+	b.mtx.Unlock()
+
+	h := hash(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[i], noop, nil
+}
+
+func newRing(instances []registry.Instance) *ring {
+	type point struct {
+		hash  uint32
+		owner registry.Instance
+	}
+	points := make([]point, 0, len(instances)*replicas)
+	for _, inst := range instances {
+		for r := 0; r < replicas; r++ {
+			points = append(points, point{hash(inst.ID + "#" + strconv.Itoa(r)), inst})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+
+	r := &ring{
+		hashes: make([]uint32, len(points)),
+		owners: make([]registry.Instance, len(points)),
+	}
+	for i, p := range points {
+		r.hashes[i] = p.hash
+		r.owners[i] = p.owner
+	}
+	return r
+}
+
+// signature identifies a set of instances regardless of their order,
+// without allocating: the sum of FNV-1a hashes of their ids and addresses.
+func signature(instances []registry.Instance) uint64 {
+	var sig uint64
+	for _, inst := range instances {
+		h := fnvString(fnvOffset, inst.ID)
+		h = fnvString(h, "@")
+		h = fnvString(h, inst.Address)
+		h ^= uint64(inst.Port)
+		h *= fnvPrime
+		sig += h
+	}
+	return sig
+}
+
+const (
+	fnvOffset = 14695981039346656037
+	fnvPrime  = 1099511628211
+)
+
+func fnvString(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= fnvPrime
+	}
+	return h
+}
+
+func hash(s string) uint32 {
+	return crc32.ChecksumIEEE([]byte(s))
+}
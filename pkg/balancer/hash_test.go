@@ -0,0 +1,152 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"go-kit-one/pkg/registry"
+	"net/http/httptest"
+	"testing"
+)
+
+func hashInstances(n int) []registry.Instance {
+	instances := make([]registry.Instance, n)
+	for i := range instances {
+		instances[i] = registry.Instance{ID: fmt.Sprintf("biz-%d", i), Service: "biz", Address: "127.0.0.1", Port: 8000 + i}
+	}
+	return instances
+}
+
+func pickAll(t *testing.T, b Balancer, instances []registry.Instance, keys int) map[string]string {
+	owners := make(map[string]string, keys)
+	for k := 0; k < keys; k++ {
+		key := fmt.Sprintf("user-%d", k)
+		inst, _, err := b.Pick(WithKey(context.Background(), key), instances)
+		if err != nil {
+			t.Fatal(err)
+		}
+		owners[key] = inst.ID
+	}
+	return owners
+}
+
+func TestConsistentHashStable(t *testing.T) {
+	instances := hashInstances(4)
+	b := NewConsistentHash()
+	first := pickAll(t, b, instances, 1000)
+
+	// the same key lands on the same instance whatever the order
+	reversed := make([]registry.Instance, len(instances))
+	for i, inst := range instances {
+		reversed[len(instances)-1-i] = inst
+	}
+	for key, owner := range pickAll(t, NewConsistentHash(), reversed, 1000) {
+		if first[key] != owner {
+			t.Fatalf("%s moved from %s to %s after reordering", key, first[key], owner)
+		}
+	}
+
+	load := make(map[string]int)
+	for _, owner := range first {
+		load[owner]++
+	}
+	for _, inst := range instances {
+		if load[inst.ID] < 100 {
+			t.Errorf("%s owns only %d of 1000 keys", inst.ID, load[inst.ID])
+		}
+	}
+}
+
+func TestConsistentHashRemapping(t *testing.T) {
+	const keys = 2000
+	instances := hashInstances(5)
+	b := NewConsistentHash()
+	before := pickAll(t, b, instances, keys)
+
+	// removing an instance only moves the keys it owned
+	after := pickAll(t, b, instances[:4], keys)
+	for key, owner := range before {
+		if owner != "biz-4" && after[key] != owner {
+			t.Fatalf("%s moved from %s to %s though its owner stayed", key, owner, after[key])
+		}
+		if after[key] == "biz-4" {
+			t.Fatalf("%s still routed to the removed instance", key)
+		}
+	}
+
+	// adding it back moves keys only onto the new instance
+	moved := 0
+	for key, owner := range pickAll(t, b, instances, keys) {
+		if owner != after[key] {
+			if owner != "biz-4" {
+				t.Fatalf("%s moved from %s to %s, not to the new instance", key, after[key], owner)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > keys/3 {
+		t.Fatalf("%d of %d keys moved to the new instance", moved, keys)
+	}
+}
+
+func TestConsistentHashCachesRings(t *testing.T) {
+	b := NewConsistentHash().(*consistentHash)
+	for n := 1; n <= maxRings+4; n++ {
+		pickAll(t, b, hashInstances(n), 1)
+	}
+	if len(b.rings) > maxRings {
+		t.Fatalf("%d rings kept, max %d", len(b.rings), maxRings)
+	}
+
+	instances := hashInstances(3)
+	pickAll(t, b, instances, 1)
+	r := b.rings[signature(instances)]
+	pickAll(t, b, []registry.Instance{instances[2], instances[0], instances[1]}, 1)
+	if b.rings[signature(instances)] != r {
+		t.Fatal("ring rebuilt for the same instances")
+	}
+}
+
+func TestConsistentHashWithoutKey(t *testing.T) {
+	instances := hashInstances(3)
+	b := NewConsistentHash()
+	seen := make(map[string]bool)
+	for i := 0; i < len(instances); i++ {
+		inst, _, err := b.Pick(context.Background(), instances)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[inst.ID] = true
+	}
+	if len(seen) != len(instances) {
+		t.Fatalf("requests without a key not balanced round-robin: %v", seen)
+	}
+}
+
+func TestKeySource(t *testing.T) {
+	r := httptest.NewRequest("GET", "/calc/users/42/add", nil)
+	r.Header.Set("X-User-Id", "u1")
+	r.Header.Set("Cookie", "uid=c1")
+	for _, tc := range []struct {
+		source string
+		want   string
+	}{
+		{"header:X-User-Id", "u1"},
+		{"cookie:uid", "c1"},
+		{"path:3", "42"},
+		{"path:9", ""},
+		{"", ""},
+	} {
+		src, err := ParseKeySource(tc.source)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.source, err)
+		}
+		if got := src.Key(r); got != tc.want {
+			t.Errorf("%s: key %q, want %q", tc.source, got, tc.want)
+		}
+	}
+	for _, s := range []string{"header", "path:x", "query:id"} {
+		if _, err := ParseKeySource(s); err == nil {
+			t.Errorf("%s accepted", s)
+		}
+	}
+}
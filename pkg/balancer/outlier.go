@@ -0,0 +1,226 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"go-kit-one/pkg/registry"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// StatusError is an upstream response with an error status. Only 5xx count
+// against the instance, 4xx are the caller's fault.
+type StatusError struct {
+	Code int
+	Err  error
+}
+
+func (e StatusError) Error() string {
+	return e.Err.Error()
+}
+
+// IsFailure reports whether err says something about the health of the
+// instance that served the request: transport errors, deadlines exceeded
+// and 5xx responses. A request the client cancelled doesn't.
+func IsFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var se StatusError
+	if errors.As(err, &se) {
+		return se.Code >= http.StatusInternalServerError
+	}
+	return true
+}
+
+// OutlierConfig enables passive outlier detection when Consecutive > 0.
+type OutlierConfig struct {
+	// Consecutive failures (5xx, timeouts, transport errors) that eject an instance.
+	Consecutive int
+	// BaseEjection is doubled for every repeated ejection, up to MaxEjection.
+	BaseEjection time.Duration
+	MaxEjection  time.Duration
+	// MaxEjectedPercent caps the share of a service's instances ejected at once.
+	MaxEjectedPercent int
+
+	Logger log.Logger
+	// Ejections is labeled with service and instance, Ejected with service.
+	Ejections metrics.Counter
+	Ejected   metrics.Gauge
+}
+
+type outlierState struct {
+	consecutive int
+	ejections   int
+	ejectedAt   time.Time
+	until       time.Time
+}
+
+// OutlierDetector tracks consecutive failures per instance of one service
+// and takes instances out of rotation for an exponentially growing period.
+type OutlierDetector struct {
+	service string
+	cfg     OutlierConfig
+
+	mtx       sync.Mutex
+	instances map[string]*outlierState
+}
+
+func NewOutlierDetector(service string, cfg OutlierConfig) *OutlierDetector {
+	if cfg.BaseEjection <= 0 {
+		cfg.BaseEjection = 30 * time.Second
+	}
+	if cfg.MaxEjection < cfg.BaseEjection {
+		cfg.MaxEjection = 10 * cfg.BaseEjection
+	}
+	if cfg.MaxEjectedPercent <= 0 {
+		cfg.MaxEjectedPercent = 50
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.NewNopLogger()
+	}
+	return &OutlierDetector{
+		service:   service,
+		cfg:       cfg,
+		instances: make(map[string]*outlierState),
+	}
+}
+
+// Filter drops ejected instances, readmitting those whose ejection expired.
+// When every instance is ejected all of them are returned, since sending
+// traffic to a bad instance beats failing every request outright.
+func (d *OutlierDetector) Filter(instances []registry.Instance) []registry.Instance {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	now := time.Now()
+	healthy := make([]registry.Instance, 0, len(instances))
+	for _, inst := range instances {
+		st, ok := d.instances[inst.ID]
+		if ok && !st.until.IsZero() {
+			if now.Before(st.until) {
+				continue
+			}
+			st.until = time.Time{}
+			st.consecutive = 0
+			d.cfg.Logger.Log("service", d.service, "instance", inst.ID, "outlier", "readmitted")
+			d.report(instances)
+		}
+		healthy = append(healthy, inst)
+	}
+	if len(healthy) == 0 {
+		return instances
+	}
+	return healthy
+}
+
+// Observe records the outcome of a request sent to inst.
+func (d *OutlierDetector) Observe(inst registry.Instance, instances []registry.Instance, err error) {
+	if errors.Is(err, context.Canceled) {
+		// says nothing either way, the streak is kept
+		return
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	st, ok := d.instances[inst.ID]
+	if !ok {
+		st = &outlierState{}
+		d.instances[inst.ID] = st
+	}
+
+	now := time.Now()
+	if !IsFailure(err) {
+		st.consecutive = 0
+		// forget past ejections once the instance stayed healthy for a while
+		if st.ejections > 0 && st.until.IsZero() && now.Sub(st.ejectedAt) > d.cfg.MaxEjection {
+			st.ejections = 0
+		}
+		return
+	}
+
+	st.consecutive++
+	if st.consecutive < d.cfg.Consecutive || !st.until.IsZero() {
+		return
+	}
+
+	ejected := d.ejected(instances)
+	if (ejected+1)*100 > d.cfg.MaxEjectedPercent*len(instances) {
+		// keep trying on later failures, but only log the first refusal
+		if st.consecutive == d.cfg.Consecutive {
+			d.cfg.Logger.Log("service", d.service, "instance", inst.ID, "outlier", "not ejected",
+				"reason", "max ejected percent reached", "ejected", ejected)
+		}
+		return
+	}
+
+	backoff := d.cfg.BaseEjection << uint(st.ejections)
+	if backoff > d.cfg.MaxEjection || backoff <= 0 {
+		backoff = d.cfg.MaxEjection
+	}
+	st.ejections++
+	st.ejectedAt = now
+	st.until = now.Add(backoff)
+	d.cfg.Logger.Log("service", d.service, "instance", inst.ID, "outlier", "ejected",
+		"consecutive", st.consecutive, "ejections", st.ejections, "backoff", backoff, "err", err)
+	if d.cfg.Ejections != nil {
+		d.cfg.Ejections.With("service", d.service, "instance", inst.ID).Add(1)
+	}
+	d.report(instances)
+}
+
+func (d *OutlierDetector) ejected(instances []registry.Instance) int {
+	now := time.Now()
+	var n int
+	for _, inst := range instances {
+		if st, ok := d.instances[inst.ID]; ok && now.Before(st.until) {
+			n++
+		}
+	}
+	return n
+}
+
+func (d *OutlierDetector) report(instances []registry.Instance) {
+	if d.cfg.Ejected != nil {
+		d.cfg.Ejected.With("service", d.service).Set(float64(d.ejected(instances)))
+	}
+}
+
+// Ejected lists the ids of currently ejected instances with the time they
+// come back.
+func (d *OutlierDetector) Ejected() map[string]time.Time {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	res := make(map[string]time.Time)
+	for id, st := range d.instances {
+		if time.Now().Before(st.until) {
+			res[id] = st.until
+		}
+	}
+	return res
+}
+
+type outlierBalancer struct {
+	detector *OutlierDetector
+	next     Balancer
+}
+
+// NewOutlierBalancer hides ejected instances from next and feeds the result
+// of every request back to the detector.
+func NewOutlierBalancer(detector *OutlierDetector, next Balancer) Balancer {
+	return &outlierBalancer{detector: detector, next: next}
+}
+
+func (b *outlierBalancer) Pick(ctx context.Context, instances []registry.Instance) (registry.Instance, Done, error) {
+	inst, done, err := b.next.Pick(ctx, b.detector.Filter(instances))
+	if err != nil {
+		return inst, done, err
+	}
+	return inst, func(err error) {
+		done(err)
+		b.detector.Observe(inst, instances, err)
+	}, nil
+}
@@ -0,0 +1,60 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-kit-one/pkg/registry"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIsFailure(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{context.Canceled, false},
+		{fmt.Errorf("call: %w", context.Canceled), false},
+		{context.DeadlineExceeded, true},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{errors.New("decode: unexpected EOF"), true},
+		{StatusError{Code: 400, Err: errors.New("bad request")}, false},
+		{StatusError{Code: 401, Err: errors.New("unauthorized")}, false},
+		{StatusError{Code: 404, Err: errors.New("not found")}, false},
+		{StatusError{Code: 429, Err: errors.New("too many requests")}, false},
+		{StatusError{Code: 500, Err: errors.New("internal server error")}, true},
+		{StatusError{Code: 502, Err: errors.New("bad gateway")}, true},
+		{StatusError{Code: 503, Err: errors.New("service unavailable")}, true},
+		{fmt.Errorf("call: %w", StatusError{Code: 504, Err: errors.New("gateway timeout")}), true},
+	} {
+		if got := IsFailure(tc.err); got != tc.want {
+			t.Errorf("IsFailure(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestOutlierDetectorEjectsOn5xxOnly(t *testing.T) {
+	instances := []registry.Instance{{ID: "a"}, {ID: "b"}}
+	d := NewOutlierDetector("biz", OutlierConfig{Consecutive: 3, BaseEjection: time.Minute})
+
+	for i := 0; i < 5; i++ {
+		d.Observe(instances[0], instances, StatusError{Code: 400, Err: errors.New("bad request")})
+		d.Observe(instances[0], instances, context.Canceled)
+	}
+	if len(d.Ejected()) != 0 {
+		t.Fatalf("ejected on client errors: %v", d.Ejected())
+	}
+
+	for i := 0; i < 3; i++ {
+		d.Observe(instances[0], instances, StatusError{Code: 500, Err: errors.New("internal server error")})
+	}
+	if _, ok := d.Ejected()["a"]; !ok {
+		t.Fatal("a not ejected after 3 consecutive 500s")
+	}
+	if got := d.Filter(instances); len(got) != 1 || got[0].ID != "b" {
+		t.Fatalf("filter: %v", got)
+	}
+}
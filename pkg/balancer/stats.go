@@ -0,0 +1,98 @@
+package balancer
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// decay is the time constant of the latency EWMA.
+	decay = 10 * time.Second
+	// errorPenalty is added to the latency sample of a failed request so
+	// failing instances look slow rather than fast.
+	errorPenalty = time.Second
+)
+
+// Stats keeps per-instance load and latency, keyed by instance id.
+type Stats struct {
+	mtx       sync.Mutex
+	instances map[string]*InstanceStats
+}
+
+func NewStats() *Stats {
+	return &Stats{instances: make(map[string]*InstanceStats)}
+}
+
+func (s *Stats) Get(id string) *InstanceStats {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	st, ok := s.instances[id]
+	if !ok {
+		st = &InstanceStats{}
+		s.instances[id] = st
+	}
+	return st
+}
+
+type InstanceStats struct {
+	mtx         sync.Mutex
+	outstanding int64
+	ewma        float64
+	lastUpdate  time.Time
+}
+
+// Start records a request being sent and returns the Done to finish it.
+func (s *InstanceStats) Start() Done {
+	begin := time.Now()
+	s.mtx.Lock()
+	s.outstanding++
+	s.mtx.Unlock()
+
+	var once sync.Once
+	return func(err error) {
+		once.Do(func() {
+			latency := time.Since(begin)
+			if err != nil {
+				latency += errorPenalty
+			}
+			s.observe(latency)
+		})
+	}
+}
+
+func (s *InstanceStats) observe(latency time.Duration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.outstanding--
+	now := time.Now()
+	sample := float64(latency)
+	if s.lastUpdate.IsZero() {
+		s.ewma = sample
+	} else {
+		w := math.Exp(-float64(now.Sub(s.lastUpdate)) / float64(decay))
+		s.ewma = s.ewma*w + sample*(1-w)
+	}
+	s.lastUpdate = now
+}
+
+func (s *InstanceStats) Outstanding() int64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.outstanding
+}
+
+func (s *InstanceStats) Latency() time.Duration {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return time.Duration(s.ewma)
+}
+
+// Cost is the EWMA latency weighted by in-flight requests. Instances
+// without samples cost nothing, so new instances get probed first.
+func (s *InstanceStats) Cost() float64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.ewma * float64(s.outstanding+1)
+}
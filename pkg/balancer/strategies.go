@@ -0,0 +1,179 @@
+package balancer
+
+import (
+	"context"
+	"go-kit-one/pkg/registry"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type roundRobin struct {
+	c uint64
+}
+
+func NewRoundRobin() Balancer {
+	return &roundRobin{}
+}
+
+func (b *roundRobin) Pick(ctx context.Context, instances []registry.Instance) (registry.Instance, Done, error) {
+	if len(instances) == 0 {
+		return registry.Instance{}, noop, ErrNoInstances
+	}
+	old := atomic.AddUint64(&b.c, 1) - 1
+	return instances[old%uint64(len(instances))], noop, nil
+}
+
+type random struct {
+	mtx sync.Mutex
+	r   *rand.Rand
+}
+
+func NewRandom() Balancer {
+	return &random{r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (b *random) Pick(ctx context.Context, instances []registry.Instance) (registry.Instance, Done, error) {
+	if len(instances) == 0 {
+		return registry.Instance{}, noop, ErrNoInstances
+	}
+	b.mtx.Lock()
+	i := b.r.Intn(len(instances))
+	b.mtx.Unlock()
+	return instances[i], noop, nil
+}
+
+// weighted is nginx's smooth weighted round-robin: every pick adds each
+// instance's weight to its current value, picks the largest and subtracts
+// the total from the winner.
+type weighted struct {
+	mtx     sync.Mutex
+	current map[string]int
+}
+
+func NewWeighted() Balancer {
+	return &weighted{current: make(map[string]int)}
+}
+
+func (b *weighted) Pick(ctx context.Context, instances []registry.Instance) (registry.Instance, Done, error) {
+	if len(instances) == 0 {
+		return registry.Instance{}, noop, ErrNoInstances
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	var (
+		total int
+		best  = -1
+		seen  = make(map[string]struct{}, len(instances))
+	)
+	for i, inst := range instances {
+		w := Weight(inst)
+		total += w
+		b.current[inst.ID] += w
+		seen[inst.ID] = struct{}{}
+		if best < 0 || b.current[inst.ID] > b.current[instances[best].ID] {
+			best = i
+		}
+	}
+	b.current[instances[best].ID] -= total
+
+	for id := range b.current {
+		if _, ok := seen[id]; !ok {
+			delete(b.current, id)
+		}
+	}
+	return instances[best], noop, nil
+}
+
+type leastRequest struct {
+	stats *Stats
+	rr    uint64
+}
+
+func NewLeastRequest() Balancer {
+	return &leastRequest{stats: NewStats()}
+}
+
+func (b *leastRequest) Pick(ctx context.Context, instances []registry.Instance) (registry.Instance, Done, error) {
+	if len(instances) == 0 {
+		return registry.Instance{}, noop, ErrNoInstances
+	}
+
+	// start at a rotating offset so ties don't always go to the first instance
+	offset := int(atomic.AddUint64(&b.rr, 1))
+	best := instances[offset%len(instances)]
+	bestLoad := b.stats.Get(best.ID).Outstanding()
+	for i := 1; i < len(instances); i++ {
+		inst := instances[(offset+i)%len(instances)]
+		if load := b.stats.Get(inst.ID).Outstanding(); load < bestLoad {
+			best, bestLoad = inst, load
+		}
+	}
+	return best, b.stats.Get(best.ID).Start(), nil
+}
+
+// p2c samples two random instances and keeps the one with the lower
+// EWMA latency scaled by its outstanding requests.
+type p2c struct {
+	stats *Stats
+
+	mtx sync.Mutex
+	r   *rand.Rand
+}
+
+func NewP2C() Balancer {
+	return &p2c{
+		stats: NewStats(),
+		r:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (b *p2c) Pick(ctx context.Context, instances []registry.Instance) (registry.Instance, Done, error) {
+	switch len(instances) {
+	case 0:
+		return registry.Instance{}, noop, ErrNoInstances
+	case 1:
+		return instances[0], b.stats.Get(instances[0].ID).Start(), nil
+	}
+
+	b.mtx.Lock()
+	i := b.r.Intn(len(instances))
+	j := b.r.Intn(len(instances) - 1)
+	b.mtx.Unlock()
+	if j >= i {
+		j++
+	}
+
+	a, c := instances[i], instances[j]
+	if b.stats.Get(c.ID).Cost() < b.stats.Get(a.ID).Cost() {
+		a = c
+	}
+	return a, b.stats.Get(a.ID).Start(), nil
+}
+
+// zoneAware hands only same-zone instances to the wrapped balancer, falling
+// back to every instance when the local zone has none.
+type zoneAware struct {
+	zone string
+	next Balancer
+}
+
+func NewZoneAware(zone string, next Balancer) Balancer {
+	return &zoneAware{zone: zone, next: next}
+}
+
+func (b *zoneAware) Pick(ctx context.Context, instances []registry.Instance) (registry.Instance, Done, error) {
+	local := make([]registry.Instance, 0, len(instances))
+	for _, inst := range instances {
+		if inst.Meta["zone"] == b.zone {
+			local = append(local, inst)
+		}
+	}
+	if len(local) > 0 {
+		return b.next.Pick(ctx, local)
+	}
+	return b.next.Pick(ctx, instances)
+}
@@ -0,0 +1,54 @@
+package balancer
+
+import (
+	"context"
+	"go-kit-one/pkg/registry"
+	"sync"
+)
+
+type triedCtx struct{}
+
+type tried struct {
+	mtx sync.Mutex
+	ids map[string]struct{}
+}
+
+// WithTried makes picks under ctx skip instances already picked under it as
+// long as others are left, so retries and hedged requests land elsewhere.
+func WithTried(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(triedCtx{}).(*tried); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, triedCtx{}, &tried{ids: make(map[string]struct{})})
+}
+
+type avoidTried struct {
+	next Balancer
+}
+
+func (b avoidTried) Pick(ctx context.Context, instances []registry.Instance) (registry.Instance, Done, error) {
+	t, ok := ctx.Value(triedCtx{}).(*tried)
+	if !ok {
+		return b.next.Pick(ctx, instances)
+	}
+
+	t.mtx.Lock()
+	untried := make([]registry.Instance, 0, len(instances))
+	for _, inst := range instances {
+		if _, ok := t.ids[inst.ID]; !ok {
+			untried = append(untried, inst)
+		}
+	}
+	t.mtx.Unlock()
+	if len(untried) == 0 {
+		untried = instances
+	}
+
+	inst, done, err := b.next.Pick(ctx, untried)
+	if err == nil {
+		t.mtx.Lock()
+		t.ids[inst.ID] = struct{}{}
+		t.mtx.Unlock()
+	}
+	return inst, done, err
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	kitJwt "github.com/go-kit/kit/auth/jwt"
+	"github.com/go-kit/kit/endpoint"
+	"go-kit-one/pkg/balancer"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLogin = errors.New("login failed")
+)
+
+// tokenSource logs in at /login and hands out the token until it is about
+// to expire. Concurrent callers wait for a single login.
+type tokenSource struct {
+	username      string
+	password      string
+	refreshBefore time.Duration
+	login         endpoint.Endpoint
+
+	mtx       sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+func (s *tokenSource) Token(ctx context.Context) (string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.token != "" && time.Until(s.expiresAt) > s.refreshBefore {
+		return s.token, nil
+	}
+
+	response, err := s.login(ctx, loginRequest{Name: s.username, Pwd: s.password})
+	if err != nil {
+		return "", fmt.Errorf("%v: %v", ErrLogin, err)
+	}
+	res := response.(*loginResponse)
+	if !res.Success {
+		return "", fmt.Errorf("%v: %s", ErrLogin, res.Error)
+	}
+
+	// the token is only read for its expiry, the service checks the signature
+	claims := jwt.StandardClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(res.Token, &claims); err != nil {
+		return "", fmt.Errorf("%v: %v", ErrLogin, err)
+	}
+	s.token = res.Token
+	s.expiresAt = time.Unix(claims.ExpiresAt, 0)
+	return s.token, nil
+}
+
+// Invalidate drops token, unless it was refreshed in the meantime.
+func (s *tokenSource) Invalidate(token string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.token == token {
+		s.token = ""
+	}
+}
+
+// middleware puts the token in the context for kitJwt.ContextToHTTP. A 401
+// means the service no longer accepts the token, so it logs in again once.
+func (s *tokenSource) middleware(next endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		token, err := s.Token(ctx)
+		if err != nil {
+			return nil, err
+		}
+		response, err := next(context.WithValue(ctx, kitJwt.JWTTokenContextKey, token), request)
+
+		var se balancer.StatusError
+		if errors.As(err, &se) && se.Code == http.StatusUnauthorized {
+			s.Invalidate(token)
+			if token, err = s.Token(ctx); err != nil {
+				return nil, err
+			}
+			return next(context.WithValue(ctx, kitJwt.JWTTokenContextKey, token), request)
+		}
+		return response, err
+	}
+}
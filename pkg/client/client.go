@@ -0,0 +1,202 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/afex/hystrix-go/hystrix"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/openzipkin/zipkin-go"
+	"go-kit-one/pkg/balancer"
+	"go-kit-one/pkg/registry"
+	"go-kit-one/pkg/retry"
+	"go-kit-one/pkg/tlsconfig"
+	"net/http"
+	"time"
+)
+
+var (
+	ErrNoRegistry = errors.New("client needs a registry")
+)
+
+// Service is the typed view of the biz service.
+type Service interface {
+	Add(ctx context.Context, a, b int) (int, error)
+
+	Sub(ctx context.Context, a, b int) (int, error)
+
+	Mul(ctx context.Context, a, b int) (int, error)
+
+	Div(ctx context.Context, a, b int) (int, error)
+}
+
+type Config struct {
+	Registry registry.Registry
+	// Service and Tags select the instances, default "biz" with tags biz, vc.
+	Service string
+	Tags    []string
+
+	// Username and Password are exchanged for a token at /login, which is
+	// refreshed RefreshBefore it expires, default one minute.
+	Username      string
+	Password      string
+	RefreshBefore time.Duration
+
+	// Balancer is a strategy understood by balancer.New, default round_robin.
+	Balancer string
+	Zone     string
+	Outlier  balancer.OutlierConfig
+
+	// Retry applies to every call, which has to finish within Timeout,
+	// default one second. Biz calls aren't idempotent: they are only
+	// retried when they weren't sent, and never hedged.
+	Retry   retry.Policy
+	Timeout time.Duration
+
+	// Hystrix configures the circuit breaker around every call, the command
+	// is named after the service.
+	Hystrix hystrix.CommandConfig
+
+	// TLS calls the instances over https, presenting its certificate and
+	// checking theirs is issued to Service; nil calls them over http.
+	TLS *tlsconfig.Store
+
+	// Tracer adds a zipkin span per HTTP call, nil disables tracing.
+	Tracer *zipkin.Tracer
+	Logger log.Logger
+}
+
+// Client implements Service on top of service discovery.
+type Client struct {
+	instancer *registry.Instancer
+	tokens    *tokenSource
+
+	add endpoint.Endpoint
+	sub endpoint.Endpoint
+	mul endpoint.Endpoint
+	div endpoint.Endpoint
+}
+
+func New(cfg Config) (*Client, error) {
+	if cfg.Registry == nil {
+		return nil, ErrNoRegistry
+	}
+	if cfg.Service == "" {
+		cfg.Service = "biz"
+		if cfg.Tags == nil {
+			cfg.Tags = []string{"biz", "vc"}
+		}
+	}
+	if cfg.RefreshBefore <= 0 {
+		cfg.RefreshBefore = time.Minute
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second
+	}
+	if cfg.Retry.Latency == nil {
+		cfg.Retry.Latency = retry.NewLatencyTracker()
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.NewNopLogger()
+	}
+
+	balancers, err := balancer.NewGroup(cfg.Balancer, cfg.Zone, cfg.Outlier)
+	if err != nil {
+		return nil, err
+	}
+	instancer := registry.NewInstancer(cfg.Registry, cfg.Service, cfg.Tags, 10*time.Second, cfg.Logger)
+	b := balancers.Get(cfg.Service)
+
+	target := target{scheme: "http", tracer: cfg.Tracer}
+	if cfg.TLS != nil {
+		target.scheme = "https"
+		target.client = &http.Client{Transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			TLSClientConfig:   cfg.TLS.ClientConfig(cfg.Service),
+			ForceAttemptHTTP2: true,
+		}}
+	}
+
+	call := func(path string, enc encodeFunc, dec decodeFunc, policy retry.Policy) endpoint.Endpoint {
+		eb := balancer.NewEndpointBalancer(instancer, target.factory(path, enc, dec), b, cfg.Logger)
+		return retry.Endpoint(policy, eb, cfg.Timeout)
+	}
+
+	tokens := &tokenSource{
+		username:      cfg.Username,
+		password:      cfg.Password,
+		refreshBefore: cfg.RefreshBefore,
+		login:         call("/login", encodeLoginRequest, decodeLoginResponse, cfg.Retry),
+	}
+
+	hystrix.ConfigureCommand(cfg.Service, cfg.Hystrix)
+	breaker := circuitBreaker(cfg.Service)
+	biz := call("/biz", encodeBizRequest, decodeBizResponse, cfg.Retry.NonIdempotent())
+	makeEndpoint := func(op string) endpoint.Endpoint {
+		return breaker(tokens.middleware(operation(op)(biz)))
+	}
+
+	return &Client{
+		instancer: instancer,
+		tokens:    tokens,
+		add:       makeEndpoint("Add"),
+		sub:       makeEndpoint("Sub"),
+		mul:       makeEndpoint("Mul"),
+		div:       makeEndpoint("Div"),
+	}, nil
+}
+
+func (c *Client) Add(ctx context.Context, a, b int) (int, error) {
+	return result(c.add(ctx, bizRequest{A: a, B: b}))
+}
+
+func (c *Client) Sub(ctx context.Context, a, b int) (int, error) {
+	return result(c.sub(ctx, bizRequest{A: a, B: b}))
+}
+
+func (c *Client) Mul(ctx context.Context, a, b int) (int, error) {
+	return result(c.mul(ctx, bizRequest{A: a, B: b}))
+}
+
+func (c *Client) Div(ctx context.Context, a, b int) (int, error) {
+	return result(c.div(ctx, bizRequest{A: a, B: b}))
+}
+
+// Close stops watching the registry.
+func (c *Client) Close() {
+	c.instancer.Stop()
+}
+
+// circuitBreaker runs every call as a hystrix command, so the circuit opens
+// once too many calls fail and calls fail fast with hystrix.ErrCircuitOpen.
+func circuitBreaker(command string) endpoint.Middleware {
+	type outcome struct {
+		response interface{}
+		err      error
+	}
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			done := make(chan outcome, 1)
+			err := hystrix.Do(command, func() error {
+				response, err := next(ctx, request)
+				done <- outcome{response, err}
+				return err
+			}, nil)
+			select {
+			case o := <-done:
+				return o.response, o.err
+			default:
+				// rejected, or timed out before the call came back
+				return nil, err
+			}
+		}
+	}
+}
+
+func result(response interface{}, err error) (int, error) {
+	if err != nil {
+		return 0, err
+	}
+	res := response.(*bizResponse)
+	return res.Result, res.err()
+}
@@ -0,0 +1,161 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	kitJwt "github.com/go-kit/kit/auth/jwt"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/sd"
+	kitZipkin "github.com/go-kit/kit/tracing/zipkin"
+	kitHttp "github.com/go-kit/kit/transport/http"
+	"github.com/google/uuid"
+	"github.com/openzipkin/zipkin-go"
+	"go-kit-one/pkg/balancer"
+	"go-kit-one/pkg/idempotency"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrRemote = errors.New("biz service returned an error")
+)
+
+type encodeFunc = kitHttp.EncodeRequestFunc
+type decodeFunc = kitHttp.DecodeResponseFunc
+
+type bizRequest struct {
+	Op  string
+	A   int
+	B   int
+	Key string
+}
+
+type bizResponse struct {
+	Result int             `json:"result"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// err turns the error field into an error. The service encodes its error
+// values as empty objects, so only the presence of one is known.
+func (r *bizResponse) err() error {
+	if len(r.Error) == 0 || string(r.Error) == "null" {
+		return nil
+	}
+	if s := strings.Trim(string(r.Error), `"`); s != "{}" && s != "" {
+		return fmt.Errorf("%v: %s", ErrRemote, s)
+	}
+	return ErrRemote
+}
+
+type loginRequest struct {
+	Name string `json:"name"`
+	Pwd  string `json:"pwd"`
+}
+
+type loginResponse struct {
+	Success bool   `json:"success"`
+	Token   string `json:"token"`
+	Error   string `json:"error"`
+}
+
+// target says how instances are called: the scheme, the HTTP client shared
+// by all instances, nil for the default one, and the tracer.
+type target struct {
+	scheme string
+	client *http.Client
+	tracer *zipkin.Tracer
+}
+
+// factory builds the go-kit HTTP client endpoint for one instance.
+func (t target) factory(path string, enc encodeFunc, dec decodeFunc) sd.Factory {
+	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
+		tgt, err := url.Parse(t.scheme + "://" + instance + path)
+		if err != nil {
+			return nil, nil, err
+		}
+		options := []kitHttp.ClientOption{
+			kitHttp.ClientBefore(kitJwt.ContextToHTTP()),
+		}
+		if t.client != nil {
+			options = append(options, kitHttp.SetClient(t.client))
+		}
+		if t.tracer != nil {
+			options = append(options, kitZipkin.HTTPClientTrace(t.tracer))
+		}
+		return kitHttp.NewClient("POST", tgt, enc, dec, options...).Endpoint(), nil, nil
+	}
+}
+
+// operation fills in the operation the endpoint calls, and an idempotency
+// key shared by all attempts of the call so retries aren't executed twice.
+func operation(op string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			req := request.(bizRequest)
+			req.Op = op
+			req.Key = uuid.New().String()
+			return next(ctx, req)
+		}
+	}
+}
+
+func encodeBizRequest(ctx context.Context, r *http.Request, request interface{}) error {
+	req := request.(bizRequest)
+	r.URL.Path += "/" + req.Op + "/" + strconv.Itoa(req.A) + "/" + strconv.Itoa(req.B)
+	r.Header.Set(idempotency.Header, req.Key)
+	return nil
+}
+
+func decodeBizResponse(ctx context.Context, resp *http.Response) (interface{}, error) {
+	if err := statusError(resp); err != nil {
+		return nil, err
+	}
+	response := &bizResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func encodeLoginRequest(ctx context.Context, r *http.Request, request interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json;charset=utf-8")
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return nil
+}
+
+func decodeLoginResponse(ctx context.Context, resp *http.Response) (interface{}, error) {
+	if err := statusError(resp); err != nil {
+		return nil, err
+	}
+	response := &loginResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// statusError keeps the status code of failed responses so retries and
+// outlier detection can tell 5xx from 4xx.
+func statusError(resp *http.Response) error {
+	if resp.StatusCode < 400 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	msg := strings.TrimSpace(string(body))
+	if msg == "" {
+		msg = resp.Status
+	}
+	return balancer.StatusError{Code: resp.StatusCode, Err: errors.New(msg)}
+}
@@ -0,0 +1,588 @@
+// Package consulfake is an in-process stand-in for the parts of the Consul
+// HTTP API used by the biz examples: agent service registration, TTL and
+// HTTP checks, maintenance mode, the catalog and health endpoints with
+// blocking queries. It lets a register -> discover -> gateway topology run
+// inside a single process:
+//
+//	fake, _ := consulfake.Start("127.0.0.1:0")
+//	defer fake.Close()
+//	reg, _ := registry.New("consul://" + fake.Addr())
+package consulfake
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/consul/api"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	NodeName   = "consulfake"
+	Datacenter = "dc1"
+
+	maintCheckPrefix = "_service_maintenance:"
+	maxWait          = 10 * time.Minute
+	defaultWait      = 5 * time.Minute
+	tick             = 100 * time.Millisecond
+)
+
+type Server struct {
+	mtx      sync.Mutex
+	index    uint64
+	changed  chan struct{}
+	services map[string]*service
+	checks   map[string]*check
+
+	nodeAddr string
+	listener net.Listener
+	server   *http.Server
+	client   *http.Client
+	quit     chan struct{}
+	once     sync.Once
+}
+
+type service struct {
+	svc         *api.AgentService
+	maintenance string
+	inMaint     bool
+}
+
+type check struct {
+	id        string
+	serviceID string
+	def       api.AgentServiceCheck
+	status    string
+	output    string
+
+	interval        time.Duration
+	timeout         time.Duration
+	ttl             time.Duration
+	deregisterAfter time.Duration
+
+	nextRun       time.Time
+	running       bool
+	ttlDeadline   time.Time
+	criticalSince time.Time
+}
+
+func New() *Server {
+	s := &Server{
+		index:    1,
+		changed:  make(chan struct{}),
+		services: make(map[string]*service),
+		checks:   make(map[string]*check),
+		nodeAddr: "127.0.0.1",
+		client:   &http.Client{},
+		quit:     make(chan struct{}),
+	}
+	s.server = &http.Server{Handler: s.Handler()}
+	return s
+}
+
+// Start listens on addr ("127.0.0.1:0" picks a free port) and serves the
+// fake API until Close is called.
+func Start(addr string) (*Server, error) {
+	s := New()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s.listener = l
+	go s.server.Serve(l)
+	go s.loop()
+	return s, nil
+}
+
+func (s *Server) Addr() string {
+	if s.listener == nil {
+		return ""
+	}
+	return s.listener.Addr().String()
+}
+
+func (s *Server) Close() error {
+	s.once.Do(func() { close(s.quit) })
+	return s.server.Close()
+}
+
+func (s *Server) Handler() http.Handler {
+	r := mux.NewRouter()
+	r.Methods("PUT").Path("/v1/agent/service/register").HandlerFunc(s.registerService)
+	r.Methods("PUT").Path("/v1/agent/service/deregister/{id}").HandlerFunc(s.deregisterService)
+	r.Methods("PUT").Path("/v1/agent/service/maintenance/{id}").HandlerFunc(s.serviceMaintenance)
+	r.Methods("GET").Path("/v1/agent/services").HandlerFunc(s.agentServices)
+	r.Methods("PUT").Path("/v1/agent/check/update/{id}").HandlerFunc(s.updateCheck)
+	r.Methods("PUT").Path("/v1/agent/check/{status:pass|warn|fail}/{id}").HandlerFunc(s.updateCheck)
+	r.Methods("GET").Path("/v1/agent/self").HandlerFunc(s.agentSelf)
+	r.Methods("GET").Path("/v1/status/leader").HandlerFunc(s.statusLeader)
+	r.Methods("GET").Path("/v1/catalog/services").HandlerFunc(s.catalogServices)
+	r.Methods("GET").Path("/v1/catalog/service/{name}").HandlerFunc(s.catalogService)
+	r.Methods("GET").Path("/v1/health/service/{name}").HandlerFunc(s.healthService)
+	return r
+}
+
+// notify must be called with s.mtx held.
+func (s *Server) notify() {
+	s.index++
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Server) registerService(w http.ResponseWriter, r *http.Request) {
+	var reg api.AgentServiceRegistration
+	if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if reg.Name == "" {
+		http.Error(w, "Missing service name", http.StatusBadRequest)
+		return
+	}
+	if reg.ID == "" {
+		reg.ID = reg.Name
+	}
+
+	svc := &api.AgentService{
+		ID:      reg.ID,
+		Service: reg.Name,
+		Tags:    reg.Tags,
+		Meta:    reg.Meta,
+		Port:    reg.Port,
+		Address: reg.Address,
+		Weights: api.AgentWeights{Passing: 1, Warning: 1},
+	}
+	if reg.Weights != nil {
+		svc.Weights = *reg.Weights
+	}
+
+	defs := reg.Checks
+	if reg.Check != nil {
+		defs = append([]*api.AgentServiceCheck{reg.Check}, defs...)
+	}
+
+	now := time.Now()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.removeService(reg.ID)
+	s.index++
+	svc.CreateIndex, svc.ModifyIndex = s.index, s.index
+	s.services[reg.ID] = &service{svc: svc}
+
+	for i, def := range defs {
+		c := &check{
+			id:        def.CheckID,
+			serviceID: reg.ID,
+			def:       *def,
+			status:    api.HealthCritical,
+			nextRun:   now,
+		}
+		if c.id == "" {
+			c.id = "service:" + reg.ID
+			if len(defs) > 1 {
+				c.id += ":" + strconv.Itoa(i+1)
+			}
+		}
+		if def.Status != "" {
+			c.status = def.Status
+		}
+		c.interval = parseDuration(def.Interval, 10*time.Second)
+		c.timeout = parseDuration(def.Timeout, 10*time.Second)
+		c.ttl = parseDuration(def.TTL, 0)
+		c.deregisterAfter = parseDuration(def.DeregisterCriticalServiceAfter, 0)
+		if c.ttl > 0 {
+			c.ttlDeadline = now.Add(c.ttl)
+		}
+		if c.status == api.HealthCritical {
+			c.criticalSince = now
+		}
+		s.checks[c.id] = c
+	}
+	s.notify()
+}
+
+func (s *Server) deregisterService(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.services[id]; !ok {
+		http.Error(w, "Unknown service ID "+strconv.Quote(id), http.StatusNotFound)
+		return
+	}
+	s.removeService(id)
+	s.notify()
+}
+
+// removeService must be called with s.mtx held.
+func (s *Server) removeService(id string) {
+	delete(s.services, id)
+	for checkID, c := range s.checks {
+		if c.serviceID == id {
+			delete(s.checks, checkID)
+		}
+	}
+}
+
+func (s *Server) serviceMaintenance(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	enable, err := strconv.ParseBool(r.URL.Query().Get("enable"))
+	if err != nil {
+		http.Error(w, "Missing or invalid enable flag", http.StatusBadRequest)
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	svc, ok := s.services[id]
+	if !ok {
+		http.Error(w, "Unknown service ID "+strconv.Quote(id), http.StatusNotFound)
+		return
+	}
+	svc.inMaint = enable
+	svc.maintenance = r.URL.Query().Get("reason")
+	s.notify()
+}
+
+func (s *Server) updateCheck(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	status, output := "", r.URL.Query().Get("note")
+	switch vars["status"] {
+	case "pass":
+		status = api.HealthPassing
+	case "warn":
+		status = api.HealthWarning
+	case "fail":
+		status = api.HealthCritical
+	default:
+		var update struct {
+			Status string
+			Output string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status, output = update.Status, update.Output
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	c, ok := s.checks[id]
+	if !ok || c.ttl == 0 {
+		http.Error(w, "Unknown check "+strconv.Quote(id), http.StatusInternalServerError)
+		return
+	}
+	c.ttlDeadline = time.Now().Add(c.ttl)
+	s.setStatus(c, status, output)
+}
+
+// setStatus must be called with s.mtx held.
+func (s *Server) setStatus(c *check, status, output string) {
+	if c.status == status && c.output == output {
+		return
+	}
+	if status == api.HealthCritical && c.status != api.HealthCritical {
+		c.criticalSince = time.Now()
+	}
+	c.status = status
+	c.output = output
+	s.notify()
+}
+
+func (s *Server) agentServices(w http.ResponseWriter, r *http.Request) {
+	s.mtx.Lock()
+	res := make(map[string]*api.AgentService, len(s.services))
+	for id, svc := range s.services {
+		res[id] = svc.svc
+	}
+	s.mtx.Unlock()
+	writeJSON(w, res)
+}
+
+func (s *Server) agentSelf(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"Config": map[string]interface{}{
+			"Datacenter": Datacenter,
+			"NodeName":   NodeName,
+		},
+		"Member": map[string]interface{}{
+			"Name": NodeName,
+			"Addr": s.nodeAddr,
+		},
+	})
+}
+
+func (s *Server) statusLeader(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.nodeAddr+":8300")
+}
+
+func (s *Server) catalogServices(w http.ResponseWriter, r *http.Request) {
+	s.block(w, r, func() interface{} {
+		res := make(map[string][]string)
+		for _, svc := range s.services {
+			if _, ok := res[svc.svc.Service]; !ok {
+				res[svc.svc.Service] = []string{}
+			}
+			res[svc.svc.Service] = append(res[svc.svc.Service], svc.svc.Tags...)
+		}
+		return res
+	})
+}
+
+func (s *Server) catalogService(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	tags := r.URL.Query()["tag"]
+	s.block(w, r, func() interface{} {
+		res := make([]*api.CatalogService, 0)
+		for _, svc := range s.matching(name, tags) {
+			res = append(res, &api.CatalogService{
+				ID:             svc.svc.ID,
+				Node:           NodeName,
+				Address:        s.nodeAddr,
+				Datacenter:     Datacenter,
+				ServiceID:      svc.svc.ID,
+				ServiceName:    svc.svc.Service,
+				ServiceAddress: svc.svc.Address,
+				ServiceTags:    svc.svc.Tags,
+				ServiceMeta:    svc.svc.Meta,
+				ServicePort:    svc.svc.Port,
+				ServiceWeights: api.Weights{Passing: svc.svc.Weights.Passing, Warning: svc.svc.Weights.Warning},
+				CreateIndex:    svc.svc.CreateIndex,
+				ModifyIndex:    svc.svc.ModifyIndex,
+			})
+		}
+		return res
+	})
+}
+
+func (s *Server) healthService(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	query := r.URL.Query()
+	tags := query["tag"]
+	_, passingOnly := query["passing"]
+	s.block(w, r, func() interface{} {
+		res := make([]*api.ServiceEntry, 0)
+		for _, svc := range s.matching(name, tags) {
+			checks := s.serviceChecks(svc)
+			if passingOnly && checks.AggregatedStatus() != api.HealthPassing {
+				continue
+			}
+			res = append(res, &api.ServiceEntry{
+				Node: &api.Node{
+					ID:         NodeName,
+					Node:       NodeName,
+					Address:    s.nodeAddr,
+					Datacenter: Datacenter,
+				},
+				Service: svc.svc,
+				Checks:  checks,
+			})
+		}
+		return res
+	})
+}
+
+// matching must be called with s.mtx held.
+func (s *Server) matching(name string, tags []string) []*service {
+	res := make([]*service, 0)
+	for _, svc := range s.services {
+		if svc.svc.Service != name || !hasTags(svc.svc.Tags, tags) {
+			continue
+		}
+		res = append(res, svc)
+	}
+	return res
+}
+
+// serviceChecks must be called with s.mtx held.
+func (s *Server) serviceChecks(svc *service) api.HealthChecks {
+	checks := api.HealthChecks{}
+	for _, c := range s.checks {
+		if c.serviceID != svc.svc.ID {
+			continue
+		}
+		checks = append(checks, &api.HealthCheck{
+			Node:        NodeName,
+			CheckID:     c.id,
+			Name:        "Service '" + svc.svc.Service + "' check",
+			Status:      c.status,
+			Notes:       c.def.Notes,
+			Output:      c.output,
+			ServiceID:   svc.svc.ID,
+			ServiceName: svc.svc.Service,
+			ServiceTags: svc.svc.Tags,
+		})
+	}
+	if svc.inMaint {
+		checks = append(checks, &api.HealthCheck{
+			Node:        NodeName,
+			CheckID:     maintCheckPrefix + svc.svc.ID,
+			Name:        "Service Maintenance Mode",
+			Status:      api.HealthMaint,
+			Notes:       svc.maintenance,
+			ServiceID:   svc.svc.ID,
+			ServiceName: svc.svc.Service,
+		})
+	}
+	return checks
+}
+
+// block implements Consul blocking queries: when the request carries an
+// index equal to the current one it waits for a change, the wait time or
+// the client going away before answering.
+func (s *Server) block(w http.ResponseWriter, r *http.Request, result func() interface{}) {
+	query := r.URL.Query()
+	index, _ := strconv.ParseUint(query.Get("index"), 10, 64)
+	wait := parseDuration(query.Get("wait"), defaultWait)
+	if wait > maxWait {
+		wait = maxWait
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	s.mtx.Lock()
+	for index > 0 && index == s.index {
+		changed := s.changed
+		s.mtx.Unlock()
+		select {
+		case <-changed:
+		case <-timer.C:
+			s.mtx.Lock()
+			index = 0
+			continue
+		case <-r.Context().Done():
+			return
+		}
+		s.mtx.Lock()
+	}
+	res, current := result(), s.index
+	s.mtx.Unlock()
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(current, 10))
+	w.Header().Set("X-Consul-KnownLeader", "true")
+	w.Header().Set("X-Consul-LastContact", "0")
+	writeJSON(w, res)
+}
+
+// loop expires TTL checks, runs HTTP checks and reaps services whose checks
+// have been critical longer than DeregisterCriticalServiceAfter.
+func (s *Server) loop() {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.runChecks(time.Now())
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func (s *Server) runChecks(now time.Time) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, c := range s.checks {
+		switch {
+		case c.ttl > 0:
+			if now.After(c.ttlDeadline) && c.status != api.HealthCritical {
+				s.setStatus(c, api.HealthCritical, "TTL expired")
+			}
+		case c.def.HTTP != "" && !c.running && !now.Before(c.nextRun):
+			c.running = true
+			c.nextRun = now.Add(c.interval)
+			go s.httpCheck(c)
+		}
+	}
+
+	for id, svc := range s.services {
+		for _, c := range s.checks {
+			if c.serviceID != id || c.deregisterAfter == 0 || c.status != api.HealthCritical {
+				continue
+			}
+			if now.Sub(c.criticalSince) >= c.deregisterAfter {
+				s.removeService(svc.svc.ID)
+				s.notify()
+				break
+			}
+		}
+	}
+}
+
+func (s *Server) httpCheck(c *check) {
+	method := c.def.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	status, output := api.HealthCritical, ""
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	req, err := http.NewRequest(method, c.def.HTTP, nil)
+	if err == nil {
+		var resp *http.Response
+		resp, err = s.client.Do(req.WithContext(ctx))
+		if err == nil {
+			resp.Body.Close()
+			output = "HTTP " + method + " " + c.def.HTTP + ": " + resp.Status
+			switch {
+			case resp.StatusCode >= 200 && resp.StatusCode < 300:
+				status = api.HealthPassing
+			case resp.StatusCode == http.StatusTooManyRequests:
+				status = api.HealthWarning
+			}
+		}
+	}
+	if err != nil {
+		output = err.Error()
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	c.running = false
+	if current, ok := s.checks[c.id]; ok && current == c {
+		s.setStatus(c, status, output)
+	}
+}
+
+func hasTags(have, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if strings.EqualFold(h, w) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func parseDuration(s string, def time.Duration) time.Duration {
+	if s == "" {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
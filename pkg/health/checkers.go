@@ -0,0 +1,137 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/openzipkin/zipkin-go/model"
+	"github.com/openzipkin/zipkin-go/reporter"
+	"go-kit-one/pkg/registry"
+	"golang.org/x/time/rate"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RegistryChecker fails when the registry backend cannot be queried.
+func RegistryChecker(reg registry.Registry, service string) Checker {
+	return CheckerFunc(func(ctx context.Context) error {
+		_, err := reg.Instances(service)
+		return err
+	})
+}
+
+// LimiterChecker fails when fewer than minFree of the limiter's burst
+// tokens are left, i.e. the service is close to rejecting requests.
+func LimiterChecker(limiter *rate.Limiter, minFree float64) Checker {
+	return CheckerFunc(func(ctx context.Context) error {
+		burst := float64(limiter.Burst())
+		if tokens := limiter.Tokens(); tokens < minFree*burst {
+			return fmt.Errorf("rate limiter saturated: %.0f of %.0f tokens left", tokens, burst)
+		}
+		return nil
+	})
+}
+
+// ZipkinMonitor tracks spans handed to a zipkin reporter against spans the
+// collector accepted, to expose the reporter backlog as a health check.
+type ZipkinMonitor struct {
+	mtx         sync.Mutex
+	queued      int64
+	delivered   int64
+	lastSuccess time.Time
+	lastErr     error
+}
+
+func NewZipkinMonitor() *ZipkinMonitor {
+	return &ZipkinMonitor{lastSuccess: time.Now()}
+}
+
+// Reporter wraps the reporter the tracer sends to.
+func (m *ZipkinMonitor) Reporter(next reporter.Reporter) reporter.Reporter {
+	return &monitoredReporter{next: next, monitor: m}
+}
+
+// Client is passed to zipkinHttp.Client so collector responses are seen.
+func (m *ZipkinMonitor) Client(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &monitoredTransport{next: http.DefaultTransport, monitor: m},
+	}
+}
+
+func (m *ZipkinMonitor) Backlog() int64 {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.queued - m.delivered
+}
+
+// Checker fails when more than maxBacklog spans are pending and nothing
+// reached the collector for stale.
+func (m *ZipkinMonitor) Checker(maxBacklog int64, stale time.Duration) Checker {
+	return CheckerFunc(func(ctx context.Context) error {
+		m.mtx.Lock()
+		defer m.mtx.Unlock()
+		backlog := m.queued - m.delivered
+		if backlog > maxBacklog && time.Since(m.lastSuccess) > stale {
+			return fmt.Errorf("zipkin backlog %d spans, last delivery %s ago: %v",
+				backlog, time.Since(m.lastSuccess).Round(time.Second), m.lastErr)
+		}
+		return nil
+	})
+}
+
+type monitoredReporter struct {
+	next    reporter.Reporter
+	monitor *ZipkinMonitor
+}
+
+func (r *monitoredReporter) Send(span model.SpanModel) {
+	r.monitor.mtx.Lock()
+	r.monitor.queued++
+	r.monitor.mtx.Unlock()
+	r.next.Send(span)
+}
+
+func (r *monitoredReporter) Close() error {
+	return r.next.Close()
+}
+
+type monitoredTransport struct {
+	next    http.RoundTripper
+	monitor *ZipkinMonitor
+}
+
+func (t *monitoredTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var spans int
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		var batch []json.RawMessage
+		if json.Unmarshal(body, &batch) == nil {
+			spans = len(batch)
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	resp, err := t.next.RoundTrip(req)
+
+	t.monitor.mtx.Lock()
+	defer t.monitor.mtx.Unlock()
+	switch {
+	case err != nil:
+		t.monitor.lastErr = err
+	case resp.StatusCode >= 300:
+		t.monitor.lastErr = fmt.Errorf("collector returned %s", resp.Status)
+	default:
+		t.monitor.delivered += int64(spans)
+		t.monitor.lastSuccess = time.Now()
+		t.monitor.lastErr = nil
+	}
+	return resp, err
+}
@@ -0,0 +1,204 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StatusUp       = "up"
+	StatusDown     = "down"
+	StatusDegraded = "degraded"
+)
+
+var (
+	ErrShuttingDown = errors.New("service is shutting down")
+)
+
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+type CheckerFunc func(ctx context.Context) error
+
+func (f CheckerFunc) Check(ctx context.Context) error {
+	return f(ctx)
+}
+
+type Result struct {
+	Status    string    `json:"status"`
+	Critical  bool      `json:"critical"`
+	Error     string    `json:"error,omitempty"`
+	Duration  string    `json:"duration"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks,omitempty"`
+}
+
+type check struct {
+	name     string
+	checker  Checker
+	critical bool
+
+	mtx    sync.Mutex
+	result Result
+}
+
+// Health runs registered checkers for the readiness endpoint and caches each
+// result for cacheTTL so frequent probes don't hammer dependencies. Failing
+// critical checks make the service not ready; non-critical ones only degrade.
+type Health struct {
+	cacheTTL time.Duration
+	timeout  time.Duration
+
+	mtx    sync.RWMutex
+	checks []*check
+
+	shuttingDown int32
+}
+
+func New(cacheTTL, timeout time.Duration) *Health {
+	return &Health{
+		cacheTTL: cacheTTL,
+		timeout:  timeout,
+	}
+}
+
+func (h *Health) Register(name string, checker Checker, critical bool) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	// a new slice, so Check can keep iterating the one it took
+	checks := make([]*check, 0, len(h.checks)+1)
+	checks = append(checks, h.checks...)
+	checks = append(checks, &check{name: name, checker: checker, critical: critical})
+	sort.Slice(checks, func(i, j int) bool { return checks[i].name < checks[j].name })
+	h.checks = checks
+}
+
+// Shutdown flips readiness to failing for good, so the registry stops
+// routing traffic here before the instance deregisters.
+func (h *Health) Shutdown() {
+	atomic.StoreInt32(&h.shuttingDown, 1)
+}
+
+func (h *Health) ShuttingDown() bool {
+	return atomic.LoadInt32(&h.shuttingDown) == 1
+}
+
+func (h *Health) Ready(ctx context.Context) bool {
+	return h.Check(ctx).Status != StatusDown
+}
+
+func (h *Health) Check(ctx context.Context) Report {
+	h.mtx.RLock()
+	checks := h.checks
+	h.mtx.RUnlock()
+
+	report := Report{
+		Status: StatusUp,
+		Checks: make(map[string]Result, len(checks)+1),
+	}
+	if h.ShuttingDown() {
+		report.Status = StatusDown
+		report.Checks["shutdown"] = Result{
+			Status:    StatusDown,
+			Critical:  true,
+			Error:     ErrShuttingDown.Error(),
+			CheckedAt: time.Now(),
+		}
+	}
+
+	var wg sync.WaitGroup
+	results := make([]Result, len(checks))
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c *check) {
+			defer wg.Done()
+			results[i] = h.run(ctx, c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	for i, c := range checks {
+		res := results[i]
+		report.Checks[c.name] = res
+		if res.Status == StatusUp {
+			continue
+		}
+		if c.critical {
+			report.Status = StatusDown
+		} else if report.Status == StatusUp {
+			report.Status = StatusDegraded
+		}
+	}
+	return report
+}
+
+func (h *Health) run(ctx context.Context, c *check) Result {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if !c.result.CheckedAt.IsZero() && time.Since(c.result.CheckedAt) < h.cacheTTL {
+		return c.result
+	}
+
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+
+	begin := time.Now()
+	err := c.checker.Check(ctx)
+	c.result = Result{
+		Status:    StatusUp,
+		Critical:  c.critical,
+		Duration:  time.Since(begin).String(),
+		CheckedAt: begin,
+	}
+	if err != nil {
+		c.result.Status = StatusDown
+		c.result.Error = err.Error()
+	}
+	return c.result
+}
+
+// LivenessHandler answers 200 as long as the process can serve HTTP; it
+// never looks at dependencies, so a restart is only triggered when the
+// process itself is stuck.
+func (h *Health) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, http.StatusOK, Report{Status: StatusUp})
+	})
+}
+
+// ReadinessHandler answers 503 while a critical check fails or the service
+// is shutting down. ?verbose=false drops per-check details.
+func (h *Health) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := h.Check(r.Context())
+		code := http.StatusOK
+		if report.Status == StatusDown {
+			code = http.StatusServiceUnavailable
+		}
+		if r.URL.Query().Get("verbose") == "false" {
+			report.Checks = nil
+		}
+		writeReport(w, code, report)
+	})
+}
+
+func writeReport(w http.ResponseWriter, code int, report Report) {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,180 @@
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/go-kit/kit/log"
+	"go-kit-one/pkg/accesslog"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+const (
+	Header         = "Idempotency-Key"
+	ReplayedHeader = "Idempotent-Replayed"
+
+	// MaxKeyLength bounds the key a client may send.
+	MaxKeyLength = 255
+	// MaxBody bounds the request bodies fingerprinted and the responses
+	// stored, requests beyond it aren't handled idempotently.
+	MaxBody = 1 << 20
+)
+
+var (
+	ErrInProgress = errors.New("a request with this idempotency key is in progress")
+	ErrMismatch   = errors.New("idempotency key was used for a different request")
+	ErrKeyTooLong = errors.New("idempotency key is longer than 255 characters")
+)
+
+// Response is a stored response, replayed for every later request with the
+// same key.
+type Response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// Store keeps one record per key, first reserved by Begin and then either
+// filled by Complete or released by Abort. Implementations must be safe for
+// concurrent use and drop records after their TTL.
+type Store interface {
+	// Begin reserves key for a request with fingerprint. It returns the
+	// stored response once the key completed, ErrInProgress while another
+	// request holds it and ErrMismatch when the key was used for a request
+	// with another fingerprint.
+	Begin(key, fingerprint string) (*Response, error)
+	Complete(key string, resp *Response) error
+	Abort(key string) error
+}
+
+// Middleware makes requests carrying an Idempotency-Key safe to repeat: the
+// first response for a key is stored and replayed for duplicates, with
+// Idempotent-Replayed set. A duplicate arriving while the first request is
+// still running gets 409, one reusing the key for another request 422.
+//
+// Keys are scoped by the Authorization header, so clients can't replay each
+// other's responses. Server errors and responses to requests that weren't
+// executed (401, 429) aren't stored, so the request can be retried.
+func Middleware(store Store, logger log.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(Header)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > MaxKeyLength {
+				http.Error(w, ErrKeyTooLong.Error(), http.StatusBadRequest)
+				return
+			}
+
+			body, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxBody+1))
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			if err != nil || len(body) > MaxBody {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key = digest(r.Header.Get("Authorization")) + ":" + key
+			resp, err := store.Begin(key, digest(r.Method+" "+r.URL.RequestURI()+"\n"+string(body)))
+			switch err {
+			case nil:
+			case ErrInProgress:
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			case ErrMismatch:
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			default:
+				// without a working store the request runs unprotected
+				logger.Log("idempotency", "begin", "err", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			if resp != nil {
+				replay(w, resp)
+				return
+			}
+
+			rec := &recorder{ResponseWriter: w}
+			defer func() {
+				if p := recover(); p != nil {
+					store.Abort(key)
+					panic(p)
+				}
+				if rec.stored() {
+					header := w.Header().Clone()
+					header.Del(accesslog.RequestIDHeader)
+					err = store.Complete(key, &Response{Status: rec.Status(), Header: header, Body: rec.body.Bytes()})
+				} else {
+					err = store.Abort(key)
+				}
+				if err != nil {
+					logger.Log("idempotency", "finish", "err", err)
+				}
+			}()
+			next.ServeHTTP(rec, r)
+		})
+	}
+}
+
+func replay(w http.ResponseWriter, resp *Response) {
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(ReplayedHeader, "true")
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp.Body)))
+	w.WriteHeader(resp.Status)
+	w.Write(resp.Body)
+}
+
+func digest(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:16])
+}
+
+// recorder keeps the response written through it, up to MaxBody.
+type recorder struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (rec *recorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if rec.body.Len()+len(b) > MaxBody {
+		rec.truncated = true
+	} else {
+		rec.body.Write(b)
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *recorder) Status() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+func (rec *recorder) stored() bool {
+	status := rec.Status()
+	return !rec.truncated && status < 500 && status != http.StatusUnauthorized && status != http.StatusTooManyRequests
+}
@@ -0,0 +1,119 @@
+package idempotency
+
+import (
+	"github.com/go-kit/kit/log"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestHandler(t *testing.T, status int, calls *int32, block chan struct{}) http.Handler {
+	store := NewMemoryStore(time.Minute, 0)
+	t.Cleanup(store.Stop)
+	return Middleware(store, log.NewNopLogger())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(calls, 1)
+		if block != nil {
+			<-block
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Call", strconv.Itoa(int(n)))
+		w.WriteHeader(status)
+		w.Write(body)
+	}))
+}
+
+func serve(h http.Handler, key, auth, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/calc/add", strings.NewReader(body))
+	if key != "" {
+		r.Header.Set(Header, key)
+	}
+	if auth != "" {
+		r.Header.Set("Authorization", auth)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestMiddlewareReplays(t *testing.T) {
+	var calls int32
+	h := newTestHandler(t, http.StatusCreated, &calls, nil)
+
+	first := serve(h, "k1", "Bearer a", `{"a":1}`)
+	second := serve(h, "k1", "Bearer a", `{"a":1}`)
+	if calls != 1 {
+		t.Fatalf("handler ran %d times", calls)
+	}
+	if second.Code != http.StatusCreated || second.Body.String() != `{"a":1}` || second.Header().Get("X-Call") != "1" {
+		t.Fatalf("replay: %d %q %v", second.Code, second.Body.String(), second.Header())
+	}
+	if second.Header().Get(ReplayedHeader) != "true" || first.Header().Get(ReplayedHeader) != "" {
+		t.Fatalf("replayed header: first %q, second %q", first.Header().Get(ReplayedHeader), second.Header().Get(ReplayedHeader))
+	}
+
+	// keys are scoped by the credentials and absent keys aren't deduplicated
+	serve(h, "k1", "Bearer b", `{"a":1}`)
+	serve(h, "", "Bearer a", `{"a":1}`)
+	if calls != 3 {
+		t.Fatalf("handler ran %d times, want 3", calls)
+	}
+}
+
+func TestMiddlewareMismatch(t *testing.T) {
+	var calls int32
+	h := newTestHandler(t, http.StatusOK, &calls, nil)
+	serve(h, "k1", "", `{"a":1}`)
+	if w := serve(h, "k1", "", `{"a":2}`); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("reused key: %d", w.Code)
+	}
+	if calls != 1 {
+		t.Fatalf("handler ran %d times", calls)
+	}
+}
+
+func TestMiddlewareInProgress(t *testing.T) {
+	var calls int32
+	block := make(chan struct{})
+	h := newTestHandler(t, http.StatusOK, &calls, block)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- serve(h, "k1", "", "x") }()
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if w := serve(h, "k1", "", "x"); w.Code != http.StatusConflict {
+		t.Fatalf("duplicate in progress: %d", w.Code)
+	}
+	close(block)
+	if w := <-done; w.Code != http.StatusOK {
+		t.Fatalf("first request: %d", w.Code)
+	}
+	if w := serve(h, "k1", "", "x"); w.Header().Get(ReplayedHeader) != "true" {
+		t.Fatal("completed request not replayed")
+	}
+}
+
+func TestMiddlewareRetriesServerErrors(t *testing.T) {
+	var calls int32
+	h := newTestHandler(t, http.StatusServiceUnavailable, &calls, nil)
+	serve(h, "k1", "", "x")
+	if w := serve(h, "k1", "", "x"); w.Code != http.StatusServiceUnavailable || w.Header().Get(ReplayedHeader) != "" {
+		t.Fatalf("retry after a server error: %d %v", w.Code, w.Header())
+	}
+	if calls != 2 {
+		t.Fatalf("handler ran %d times, want 2", calls)
+	}
+}
+
+func TestMiddlewareKeyTooLong(t *testing.T) {
+	var calls int32
+	h := newTestHandler(t, http.StatusOK, &calls, nil)
+	if w := serve(h, strings.Repeat("k", MaxKeyLength+1), "", "x"); w.Code != http.StatusBadRequest || calls != 0 {
+		t.Fatalf("long key: %d, %d calls", w.Code, calls)
+	}
+}
@@ -0,0 +1,131 @@
+package idempotency
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// maxSweepInterval bounds how long expired records are kept in memory.
+const maxSweepInterval = time.Minute
+
+type record struct {
+	key         string
+	fingerprint string
+	response    *Response
+	expires     time.Time
+}
+
+// MemoryStore keeps records in process memory for TTL, so duplicates are
+// only recognized by the instance that served the first request. At most
+// maxKeys records are kept, the least recently used ones are dropped first.
+type MemoryStore struct {
+	ttl     time.Duration
+	maxKeys int
+	quit    chan struct{}
+
+	mtx     sync.Mutex
+	lru     *list.List
+	records map[string]*list.Element
+}
+
+func NewMemoryStore(ttl time.Duration, maxKeys int) *MemoryStore {
+	s := &MemoryStore{
+		ttl:     ttl,
+		maxKeys: maxKeys,
+		quit:    make(chan struct{}),
+		lru:     list.New(),
+		records: make(map[string]*list.Element),
+	}
+	go s.loop()
+	return s
+}
+
+func (s *MemoryStore) Begin(key, fingerprint string) (*Response, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	now := time.Now()
+	if el, ok := s.records[key]; ok {
+		rec := el.Value.(*record)
+		if now.Before(rec.expires) {
+			s.lru.MoveToFront(el)
+			if rec.fingerprint != fingerprint {
+				return nil, ErrMismatch
+			}
+			if rec.response == nil {
+				return nil, ErrInProgress
+			}
+			return rec.response, nil
+		}
+		s.remove(el)
+	}
+	s.records[key] = s.lru.PushFront(&record{key: key, fingerprint: fingerprint, expires: now.Add(s.ttl)})
+	for s.maxKeys > 0 && s.lru.Len() > s.maxKeys {
+		s.remove(s.lru.Back())
+	}
+	return nil, nil
+}
+
+func (s *MemoryStore) Complete(key string, resp *Response) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if el, ok := s.records[key]; ok {
+		rec := el.Value.(*record)
+		rec.response = resp
+		rec.expires = time.Now().Add(s.ttl)
+		s.lru.MoveToFront(el)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Abort(key string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if el, ok := s.records[key]; ok && el.Value.(*record).response == nil {
+		s.remove(el)
+	}
+	return nil
+}
+
+// Stop ends the background sweeps.
+func (s *MemoryStore) Stop() {
+	close(s.quit)
+}
+
+func (s *MemoryStore) loop() {
+	interval := s.ttl
+	if interval <= 0 || interval > maxSweepInterval {
+		interval = maxSweepInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.sweep()
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// sweep drops expired records.
+func (s *MemoryStore) sweep() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	now := time.Now()
+	for el := s.lru.Back(); el != nil; {
+		prev := el.Prev()
+		if now.After(el.Value.(*record).expires) {
+			s.remove(el)
+		}
+		el = prev
+	}
+}
+
+// remove must be called with mtx held.
+func (s *MemoryStore) remove(el *list.Element) {
+	rec := s.lru.Remove(el).(*record)
+	delete(s.records, rec.key)
+}
@@ -0,0 +1,85 @@
+package idempotency
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore(time.Minute, 0)
+	defer s.Stop()
+
+	if resp, err := s.Begin("k", "a"); resp != nil || err != nil {
+		t.Fatalf("first begin: %v %v", resp, err)
+	}
+	if _, err := s.Begin("k", "a"); err != ErrInProgress {
+		t.Fatalf("begin while in progress: %v", err)
+	}
+	if _, err := s.Begin("k", "b"); err != ErrMismatch {
+		t.Fatalf("begin with another fingerprint: %v", err)
+	}
+
+	s.Complete("k", &Response{Status: 201, Body: []byte("created")})
+	resp, err := s.Begin("k", "a")
+	if err != nil || resp == nil || resp.Status != 201 || string(resp.Body) != "created" {
+		t.Fatalf("begin after completion: %v %v", resp, err)
+	}
+	if _, err := s.Begin("k", "b"); err != ErrMismatch {
+		t.Fatalf("completed key with another fingerprint: %v", err)
+	}
+
+	// aborting releases the key, but never drops a stored response
+	s.Begin("j", "a")
+	s.Abort("j")
+	if resp, err := s.Begin("j", "b"); resp != nil || err != nil {
+		t.Fatalf("begin after abort: %v %v", resp, err)
+	}
+	s.Abort("k")
+	if resp, _ := s.Begin("k", "a"); resp == nil {
+		t.Fatal("abort dropped a completed response")
+	}
+}
+
+func TestMemoryStoreTTL(t *testing.T) {
+	s := NewMemoryStore(50*time.Millisecond, 0)
+	defer s.Stop()
+
+	s.Begin("k", "a")
+	s.Complete("k", &Response{Status: 200})
+	time.Sleep(80 * time.Millisecond)
+	if resp, err := s.Begin("k", "b"); resp != nil || err != nil {
+		t.Fatalf("expired key: %v %v", resp, err)
+	}
+
+	s.Begin("j", "a")
+	time.Sleep(150 * time.Millisecond)
+	s.mtx.Lock()
+	_, ok := s.records["j"]
+	s.mtx.Unlock()
+	if ok {
+		t.Fatal("expired record not swept")
+	}
+}
+
+func TestMemoryStoreLRU(t *testing.T) {
+	s := NewMemoryStore(time.Minute, 2)
+	defer s.Stop()
+
+	s.Begin("a", "a")
+	s.Complete("a", &Response{Status: 200})
+	s.Begin("b", "b")
+	s.Complete("b", &Response{Status: 200})
+	// touching a makes b the least recently used
+	s.Begin("a", "a")
+	s.Begin("c", "c")
+
+	if resp, _ := s.Begin("a", "a"); resp == nil {
+		t.Fatal("recently used key evicted")
+	}
+	if resp, err := s.Begin("b", "x"); resp != nil || err != nil {
+		t.Fatalf("least recently used key kept: %v %v", resp, err)
+	}
+	if n := s.lru.Len(); n != 2 {
+		t.Fatalf("%d records kept, max 2", n)
+	}
+}
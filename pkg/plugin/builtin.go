@@ -0,0 +1,270 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxBody bounds the bodies the JSON plugins rewrite, larger ones pass
+// through unchanged.
+const maxBody = 1 << 20
+
+var (
+	ErrNoPattern = errors.New("path plugin needs a pattern")
+)
+
+func init() {
+	Register("request_headers", func(config json.RawMessage) (Plugin, error) {
+		h := &headers{}
+		return h, decode(config, &h.rules)
+	})
+	Register("response_headers", func(config json.RawMessage) (Plugin, error) {
+		h := &headers{response: true}
+		return h, decode(config, &h.rules)
+	})
+	Register("path", newPath)
+	Register("request_json", func(config json.RawMessage) (Plugin, error) {
+		j := &jsonFields{}
+		return j, decode(config, &j.rules)
+	})
+	Register("response_json", func(config json.RawMessage) (Plugin, error) {
+		j := &jsonFields{response: true}
+		return j, decode(config, &j.rules)
+	})
+	Register("claims_to_headers", func(config json.RawMessage) (Plugin, error) {
+		c := claimsToHeaders{}
+		return c, decode(config, &c)
+	})
+}
+
+func decode(config json.RawMessage, v interface{}) error {
+	if len(config) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(config))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+type headerRules struct {
+	Set    map[string]string `json:"set,omitempty"`
+	Add    map[string]string `json:"add,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+}
+
+func (rules headerRules) apply(h http.Header) {
+	for _, name := range rules.Remove {
+		h.Del(name)
+	}
+	for name, value := range rules.Set {
+		h.Set(name, value)
+	}
+	for name, value := range rules.Add {
+		h.Add(name, value)
+	}
+}
+
+// headers removes, sets and adds request or response headers:
+// {"remove": ["X-Debug"], "set": {"X-Api-Version": "2"}, "add": {"Via": "gateway"}}
+type headers struct {
+	response bool
+	rules    headerRules
+}
+
+func (p *headers) Before(r *http.Request) error {
+	if !p.response {
+		p.rules.apply(r.Header)
+	}
+	return nil
+}
+
+func (p *headers) After(resp *http.Response) error {
+	if p.response {
+		p.rules.apply(resp.Header)
+	}
+	return nil
+}
+
+// path rewrites the upstream path by regex:
+// {"pattern": "^/v1/(.*)$", "replace": "/v2/$1"}
+type path struct {
+	regex   *regexp.Regexp
+	replace string
+}
+
+func newPath(config json.RawMessage) (Plugin, error) {
+	var cfg struct {
+		Pattern string `json:"pattern"`
+		Replace string `json:"replace"`
+	}
+	if err := decode(config, &cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Pattern == "" {
+		return nil, ErrNoPattern
+	}
+	regex, err := regexp.Compile(cfg.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &path{regex: regex, replace: cfg.Replace}, nil
+}
+
+func (p *path) Before(r *http.Request) error {
+	r.URL.Path = p.regex.ReplaceAllString(r.URL.Path, p.replace)
+	r.URL.RawPath = ""
+	if !strings.HasPrefix(r.URL.Path, "/") {
+		r.URL.Path = "/" + r.URL.Path
+	}
+	return nil
+}
+
+func (p *path) After(resp *http.Response) error {
+	return nil
+}
+
+// jsonRules address fields by dotted paths through nested objects, e.g.
+// "data.user.name". Fields are removed first, then renamed, then set.
+type jsonRules struct {
+	Remove []string                   `json:"remove,omitempty"`
+	Rename map[string]string          `json:"rename,omitempty"`
+	Set    map[string]json.RawMessage `json:"set,omitempty"`
+}
+
+// jsonFields rewrites JSON request or response bodies between API shapes:
+// {"rename": {"result": "data.value"}, "remove": ["error"], "set": {"version": 2}}
+// Bodies that aren't JSON objects pass through unchanged.
+type jsonFields struct {
+	response bool
+	rules    jsonRules
+}
+
+func (p *jsonFields) Before(r *http.Request) error {
+	if p.response {
+		// the gateway's transport then asks for gzip itself and hands back
+		// the decompressed body, which can be rewritten
+		r.Header.Del("Accept-Encoding")
+		return nil
+	}
+	if r.Body == nil || r.Body == http.NoBody || !isJSON(r.Header) {
+		return nil
+	}
+	body, err := p.rewrite(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+func (p *jsonFields) After(resp *http.Response) error {
+	if !p.response || resp.Header.Get("Content-Encoding") != "" || !isJSON(resp.Header) {
+		return nil
+	}
+	body, err := p.rewrite(resp.Body)
+	if err != nil {
+		return err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+func (p *jsonFields) rewrite(rc io.ReadCloser) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(rc, maxBody+1))
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if len(body) > maxBody || json.Unmarshal(body, &doc) != nil {
+		return body, nil
+	}
+
+	for _, field := range p.rules.Remove {
+		take(doc, field)
+	}
+	for from, to := range p.rules.Rename {
+		if v, ok := take(doc, from); ok {
+			put(doc, to, v)
+		}
+	}
+	for field, raw := range p.rules.Set {
+		var v interface{}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, fmt.Errorf("set %s: %v", field, err)
+		}
+		put(doc, field, v)
+	}
+	return json.Marshal(doc)
+}
+
+func isJSON(h http.Header) bool {
+	return strings.Contains(h.Get("Content-Type"), "json")
+}
+
+// take removes the field at path and returns its value.
+func take(doc map[string]interface{}, path string) (interface{}, bool) {
+	keys := strings.Split(path, ".")
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := doc[k].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		doc = next
+	}
+	last := keys[len(keys)-1]
+	v, ok := doc[last]
+	delete(doc, last)
+	return v, ok
+}
+
+// put sets the field at path, creating the objects on the way.
+func put(doc map[string]interface{}, path string, v interface{}) {
+	keys := strings.Split(path, ".")
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := doc[k].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			doc[k] = next
+		}
+		doc = next
+	}
+	doc[keys[len(keys)-1]] = v
+}
+
+// claimsToHeaders passes verified token claims upstream as headers:
+// {"name": "X-User-Name"}. The headers are always removed from the client
+// request first, so they can't be forged on routes without auth.
+type claimsToHeaders map[string]string
+
+func (p claimsToHeaders) Before(r *http.Request) error {
+	claims := Claims(r.Context())
+	for claim, header := range p {
+		r.Header.Del(header)
+		switch v := claims[claim].(type) {
+		case nil:
+		case float64:
+			// json numbers, e.g. exp, without exponent
+			r.Header.Set(header, strconv.FormatFloat(v, 'f', -1, 64))
+		default:
+			r.Header.Set(header, fmt.Sprint(v))
+		}
+	}
+	return nil
+}
+
+func (p claimsToHeaders) After(resp *http.Response) error {
+	return nil
+}
@@ -0,0 +1,104 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+var (
+	ErrUnknownPlugin = errors.New("unknown plugin")
+)
+
+// Plugin transforms the requests of a route on their way upstream and the
+// responses on their way back. Before sees the upstream request, with the
+// path already rewritten by the route; After works like
+// httputil.ReverseProxy.ModifyResponse.
+type Plugin interface {
+	Before(r *http.Request) error
+	After(resp *http.Response) error
+}
+
+// Config selects a plugin by name and carries its configuration.
+type Config struct {
+	Name   string          `json:"name"`
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+// Factory builds a plugin from its configuration.
+type Factory func(config json.RawMessage) (Plugin, error)
+
+var (
+	mtx       sync.RWMutex
+	factories = make(map[string]Factory)
+)
+
+// Register makes a plugin available to route configurations under name.
+func Register(name string, factory Factory) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	factories[name] = factory
+}
+
+func New(cfg Config) (Plugin, error) {
+	mtx.RLock()
+	factory, ok := factories[cfg.Name]
+	mtx.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%v: %q", ErrUnknownPlugin, cfg.Name)
+	}
+	p, err := factory(cfg.Config)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %v", cfg.Name, err)
+	}
+	return p, nil
+}
+
+// Chain runs plugins in order before the request and in reverse order after
+// the response, so the first plugin sees the final response.
+type Chain []Plugin
+
+func NewChain(cfgs []Config) (Chain, error) {
+	chain := make(Chain, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		p, err := New(cfg)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, p)
+	}
+	return chain, nil
+}
+
+func (c Chain) Before(r *http.Request) error {
+	for _, p := range c {
+		if err := p.Before(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c Chain) After(resp *http.Response) error {
+	for i := len(c) - 1; i >= 0; i-- {
+		if err := c[i].After(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type claimsKey struct{}
+
+// WithClaims hands the verified token claims of a request to plugins.
+func WithClaims(ctx context.Context, claims map[string]interface{}) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+func Claims(ctx context.Context) map[string]interface{} {
+	claims, _ := ctx.Value(claimsKey{}).(map[string]interface{})
+	return claims
+}
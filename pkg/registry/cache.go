@@ -0,0 +1,186 @@
+package registry
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cacheRefresh     = time.Second
+	cacheIdle        = 10 * time.Minute
+	cacheMaxServices = 1024
+)
+
+// cachedService is in the cache from the first lookup on; ready is closed
+// once its instancer, built outside the cache lock, is set.
+type cachedService struct {
+	service   string
+	instancer *Instancer
+	lastUsed  time.Time
+	ready     chan struct{}
+}
+
+// Cache answers Instances from one Instancer per service and tag set, so
+// lookups don't hit the registry per request. Instancers use blocking
+// queries where the backend supports them and keep serving the last known
+// instances while the registry is down. Services unused for ten minutes are
+// dropped. At most 1024 services are watched, lookups of others go to the
+// registry, so requests naming random services can't pile up watches.
+// Register and Deregister go straight to the wrapped registry.
+type Cache struct {
+	registry Registry
+	interval time.Duration
+	age      metrics.Gauge
+	logger   log.Logger
+
+	mtx      sync.Mutex
+	services map[string]*cachedService
+	stopped  bool
+
+	quit chan struct{}
+}
+
+// NewCache reports the age of each service's instances in seconds to age,
+// labeled with service; age may be nil.
+func NewCache(registry Registry, interval time.Duration, age metrics.Gauge, logger log.Logger) *Cache {
+	c := &Cache{
+		registry: registry,
+		interval: interval,
+		age:      age,
+		logger:   logger,
+		services: make(map[string]*cachedService),
+		quit:     make(chan struct{}),
+	}
+	go c.loop()
+	return c
+}
+
+func (c *Cache) Register(inst Instance) error {
+	return c.registry.Register(inst)
+}
+
+func (c *Cache) Deregister(inst Instance) error {
+	return c.registry.Deregister(inst)
+}
+
+func (c *Cache) Instances(service string, tags ...string) ([]Instance, error) {
+	key := service + "|" + strings.Join(tags, ",")
+
+	c.mtx.Lock()
+	cs, ok := c.services[key]
+	if !ok {
+		if len(c.services) >= cacheMaxServices || c.stopped {
+			c.mtx.Unlock()
+			return c.registry.Instances(service, tags...)
+		}
+		cs = &cachedService{service: service, ready: make(chan struct{})}
+		c.services[key] = cs
+	}
+	cs.lastUsed = time.Now()
+	c.mtx.Unlock()
+
+	if !ok {
+		// the first lookup queries the registry synchronously, without
+		// holding up lookups of other services
+		instancer := NewInstancer(c.registry, service, tags, c.interval, c.logger)
+		c.mtx.Lock()
+		cs.instancer = instancer
+		if c.stopped {
+			instancer.Stop()
+		}
+		c.mtx.Unlock()
+		close(cs.ready)
+	}
+	<-cs.ready
+
+	instances := cs.instancer.Instances()
+	if len(instances) == 0 && cs.instancer.LastSuccess().IsZero() {
+		return nil, cs.instancer.Err()
+	}
+	return instances, nil
+}
+
+// CacheEntry is what the cache currently holds for a service and tag set.
+type CacheEntry struct {
+	Service   string     `json:"service"`
+	Tags      []string   `json:"tags,omitempty"`
+	Instances []Instance `json:"instances"`
+	Age       float64    `json:"age_seconds"`
+	Error     string     `json:"error,omitempty"`
+}
+
+func (c *Cache) Entries() []CacheEntry {
+	c.mtx.Lock()
+	services := make([]*cachedService, 0, len(c.services))
+	for _, cs := range c.services {
+		if cs.instancer != nil {
+			services = append(services, cs)
+		}
+	}
+	c.mtx.Unlock()
+
+	entries := make([]CacheEntry, 0, len(services))
+	for _, cs := range services {
+		entry := CacheEntry{
+			Service:   cs.service,
+			Tags:      cs.instancer.tags,
+			Instances: cs.instancer.Instances(),
+			Age:       cs.instancer.Age().Seconds(),
+		}
+		if err := cs.instancer.Err(); err != nil {
+			entry.Error = err.Error()
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Service < entries[j].Service })
+	return entries
+}
+
+func (c *Cache) Stop() {
+	close(c.quit)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.stopped = true
+	for _, cs := range c.services {
+		if cs.instancer != nil {
+			cs.instancer.Stop()
+		}
+	}
+}
+
+func (c *Cache) loop() {
+	ticker := time.NewTicker(cacheRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.sweep()
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+func (c *Cache) sweep() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	now := time.Now()
+	for key, cs := range c.services {
+		if cs.instancer == nil {
+			continue
+		}
+		if now.Sub(cs.lastUsed) > cacheIdle {
+			cs.instancer.Stop()
+			delete(c.services, key)
+			continue
+		}
+		if c.age != nil {
+			c.age.With("service", cs.service).Set(cs.instancer.Age().Seconds())
+		}
+	}
+}
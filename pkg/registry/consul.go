@@ -0,0 +1,112 @@
+package registry
+
+import (
+	"context"
+	"github.com/hashicorp/consul/api"
+	"time"
+)
+
+type Consul struct {
+	client *api.Client
+}
+
+func NewConsul(client *api.Client) *Consul {
+	return &Consul{client: client}
+}
+
+func (c *Consul) Client() *api.Client {
+	return c.client
+}
+
+func (c *Consul) Register(inst Instance) error {
+	reg := &api.AgentServiceRegistration{
+		ID:      inst.ID,
+		Name:    inst.Service,
+		Address: inst.Address,
+		Port:    inst.Port,
+		Tags:    inst.Tags,
+		Meta:    inst.Meta,
+	}
+	if inst.Weight > 0 {
+		reg.Weights = &api.AgentWeights{Passing: inst.Weight, Warning: 1}
+	}
+	if inst.Check != nil {
+		check := &api.AgentServiceCheck{
+			Notes: inst.Check.Notes,
+		}
+		if inst.Check.TTL > 0 {
+			check.CheckID = ttlCheckID(inst)
+			check.TTL = inst.Check.TTL.String()
+		} else {
+			check.HTTP = inst.Check.HTTP
+			check.TLSSkipVerify = inst.Check.TLSSkipVerify
+			check.Interval = inst.Check.Interval.String()
+			check.Timeout = inst.Check.Timeout.String()
+		}
+		if inst.Check.DeregisterAfter > 0 {
+			check.DeregisterCriticalServiceAfter = inst.Check.DeregisterAfter.String()
+		}
+		reg.Check = check
+	}
+	return c.client.Agent().ServiceRegister(reg)
+}
+
+func (c *Consul) Deregister(inst Instance) error {
+	return c.client.Agent().ServiceDeregister(inst.ID)
+}
+
+func (c *Consul) Instances(service string, tags ...string) ([]Instance, error) {
+	entries, _, err := c.client.Health().ServiceMultipleTags(service, tags, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	return consulInstances(entries), nil
+}
+
+func (c *Consul) Watch(ctx context.Context, service string, tags []string, index uint64) ([]Instance, uint64, error) {
+	opts := &api.QueryOptions{WaitIndex: index, WaitTime: 5 * time.Minute}
+	entries, meta, err := c.client.Health().ServiceMultipleTags(service, tags, true, opts.WithContext(ctx))
+	if err != nil {
+		return nil, index, err
+	}
+	return consulInstances(entries), meta.LastIndex, nil
+}
+
+func (c *Consul) UpdateHealth(inst Instance, passing bool, output string) error {
+	status := api.HealthPassing
+	if !passing {
+		status = api.HealthCritical
+	}
+	return c.client.Agent().UpdateTTL(ttlCheckID(inst), output, status)
+}
+
+func (c *Consul) Maintenance(inst Instance, enable bool, reason string) error {
+	if enable {
+		return c.client.Agent().EnableServiceMaintenance(inst.ID, reason)
+	}
+	return c.client.Agent().DisableServiceMaintenance(inst.ID)
+}
+
+func ttlCheckID(inst Instance) string {
+	return "service:" + inst.ID
+}
+
+func consulInstances(entries []*api.ServiceEntry) []Instance {
+	instances := make([]Instance, 0, len(entries))
+	for _, entry := range entries {
+		addr := entry.Service.Address
+		if addr == "" {
+			addr = entry.Node.Address
+		}
+		instances = append(instances, Instance{
+			ID:      entry.Service.ID,
+			Service: entry.Service.Service,
+			Address: addr,
+			Port:    entry.Service.Port,
+			Tags:    entry.Service.Tags,
+			Meta:    entry.Service.Meta,
+			Weight:  entry.Service.Weights.Passing,
+		})
+	}
+	return instances
+}
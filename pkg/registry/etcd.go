@@ -0,0 +1,258 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultEtcdTTL = 30 * time.Second
+
+// Etcd stores instances under prefix/service/id through the etcd v3 JSON
+// gateway. Each key is bound to a lease that is kept alive while the
+// instance is registered, so crashed instances disappear after the TTL.
+type Etcd struct {
+	endpoint string
+	prefix   string
+	client   *http.Client
+
+	mtx    sync.Mutex
+	leases map[string]*etcdLease
+}
+
+type etcdLease struct {
+	id      string
+	inst    Instance
+	removed bool
+	quit    chan struct{}
+}
+
+func NewEtcd(endpoint, prefix string) *Etcd {
+	if prefix == "" || prefix == "/" {
+		prefix = "/services"
+	}
+	return &Etcd{
+		endpoint: endpoint,
+		prefix:   prefix,
+		client:   &http.Client{Timeout: 5 * time.Second},
+		leases:   make(map[string]*etcdLease),
+	}
+}
+
+func (e *Etcd) key(service, id string) string {
+	return path.Join(e.prefix, service, id)
+}
+
+func (e *Etcd) Register(inst Instance) error {
+	ttl := defaultEtcdTTL
+	if inst.Check != nil && inst.Check.TTL > 0 {
+		ttl = inst.Check.TTL
+	}
+
+	var grant struct {
+		ID string `json:"ID"`
+	}
+	if err := e.call("/v3/lease/grant", map[string]interface{}{"TTL": int64(ttl / time.Second)}, &grant); err != nil {
+		return err
+	}
+	lease := &etcdLease{id: grant.ID, inst: inst, quit: make(chan struct{})}
+	if err := e.put(lease); err != nil {
+		return err
+	}
+
+	e.mtx.Lock()
+	if old, ok := e.leases[inst.ID]; ok {
+		close(old.quit)
+	}
+	e.leases[inst.ID] = lease
+	e.mtx.Unlock()
+
+	go e.keepAlive(lease, ttl)
+	return nil
+}
+
+func (e *Etcd) put(lease *etcdLease) error {
+	value, err := json.Marshal(lease.inst)
+	if err != nil {
+		return err
+	}
+	e.mtx.Lock()
+	id := lease.id
+	e.mtx.Unlock()
+	return e.call("/v3/kv/put", map[string]interface{}{
+		"key":   b64(e.key(lease.inst.Service, lease.inst.ID)),
+		"value": base64.StdEncoding.EncodeToString(value),
+		"lease": id,
+	}, nil)
+}
+
+// keepAlive refreshes the lease every third of its ttl. Once etcd answers
+// that the lease expired, after an outage longer than the ttl, a new lease
+// is granted and the key written again.
+func (e *Etcd) keepAlive(lease *etcdLease, ttl time.Duration) {
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.mtx.Lock()
+			id := lease.id
+			e.mtx.Unlock()
+			var resp struct {
+				Result struct {
+					TTL string `json:"TTL"`
+				} `json:"result"`
+			}
+			if err := e.call("/v3/lease/keepalive", map[string]interface{}{"ID": id}, &resp); err != nil {
+				continue
+			}
+			if left, _ := strconv.ParseInt(resp.Result.TTL, 10, 64); left <= 0 {
+				e.renew(lease, ttl)
+			}
+		case <-lease.quit:
+			return
+		}
+	}
+}
+
+func (e *Etcd) renew(lease *etcdLease, ttl time.Duration) {
+	var grant struct {
+		ID string `json:"ID"`
+	}
+	if err := e.call("/v3/lease/grant", map[string]interface{}{"TTL": int64(ttl / time.Second)}, &grant); err != nil {
+		return
+	}
+	e.mtx.Lock()
+	lease.id = grant.ID
+	removed := lease.removed
+	e.mtx.Unlock()
+	if !removed {
+		e.put(lease)
+	}
+}
+
+func (e *Etcd) Deregister(inst Instance) error {
+	e.mtx.Lock()
+	lease, ok := e.leases[inst.ID]
+	delete(e.leases, inst.ID)
+	var id string
+	if ok {
+		id = lease.id
+	}
+	e.mtx.Unlock()
+
+	if ok {
+		close(lease.quit)
+		return e.call("/v3/lease/revoke", map[string]interface{}{"ID": id}, nil)
+	}
+	return e.call("/v3/kv/deleterange", map[string]interface{}{
+		"key": b64(e.key(inst.Service, inst.ID)),
+	}, nil)
+}
+
+// UpdateHealth removes a failing instance's key and restores it once the
+// instance reports passing again; the lease itself keeps running. A failed
+// call leaves the state as it was, so the next update tries again.
+func (e *Etcd) UpdateHealth(inst Instance, passing bool, output string) error {
+	e.mtx.Lock()
+	lease, ok := e.leases[inst.ID]
+	if !ok || lease.removed == !passing {
+		e.mtx.Unlock()
+		return nil
+	}
+	// set before the call, so a lease renewed meanwhile doesn't put the
+	// key back while it's being removed
+	lease.removed = !passing
+	e.mtx.Unlock()
+
+	var err error
+	if passing {
+		err = e.put(lease)
+	} else {
+		err = e.call("/v3/kv/deleterange", map[string]interface{}{
+			"key": b64(e.key(inst.Service, inst.ID)),
+		}, nil)
+	}
+	if err != nil {
+		e.mtx.Lock()
+		if lease.removed == !passing {
+			lease.removed = passing
+		}
+		e.mtx.Unlock()
+	}
+	return err
+}
+
+func (e *Etcd) Maintenance(inst Instance, enable bool, reason string) error {
+	return e.UpdateHealth(inst, !enable, reason)
+}
+
+func (e *Etcd) Instances(service string, tags ...string) ([]Instance, error) {
+	prefix := e.key(service, "") + "/"
+	var resp struct {
+		Kvs []struct {
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}
+	err := e.call("/v3/kv/range", map[string]interface{}{
+		"key":       b64(prefix),
+		"range_end": b64(prefixEnd(prefix)),
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	instances := make([]Instance, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		raw, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		var inst Instance
+		if err := json.Unmarshal(raw, &inst); err != nil {
+			return nil, err
+		}
+		instances = append(instances, inst)
+	}
+	return filterTags(instances, tags), nil
+}
+
+func (e *Etcd) call(api string, req interface{}, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := e.client.Post(e.endpoint+api, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("etcd %s: %s", api, r.Status)
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return "\x00"
+}
@@ -0,0 +1,180 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEtcd serves the parts of the etcd v3 JSON gateway Etcd uses.
+type fakeEtcd struct {
+	mtx     sync.Mutex
+	leases  int
+	expired map[string]bool
+	keys    map[string]fakeEtcdKey
+	fail    map[string]bool
+}
+
+type fakeEtcdKey struct {
+	value string
+	lease string
+}
+
+func newFakeEtcd(t *testing.T) (*fakeEtcd, string) {
+	f := &fakeEtcd{expired: make(map[string]bool), keys: make(map[string]fakeEtcdKey), fail: make(map[string]bool)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv.URL
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req map[string]string
+	json.NewDecoder(r.Body).Decode(&req)
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.fail[r.URL.Path] {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	decode := func(s string) string {
+		b, _ := base64.StdEncoding.DecodeString(s)
+		return string(b)
+	}
+	var resp interface{}
+	switch r.URL.Path {
+	case "/v3/lease/grant":
+		f.leases++
+		resp = map[string]string{"ID": strconv.Itoa(f.leases)}
+	case "/v3/lease/keepalive":
+		ttl := "30"
+		if f.expired[req["ID"]] {
+			ttl = ""
+		}
+		resp = map[string]interface{}{"result": map[string]string{"TTL": ttl}}
+	case "/v3/lease/revoke":
+		for key, kv := range f.keys {
+			if kv.lease == req["ID"] {
+				delete(f.keys, key)
+			}
+		}
+	case "/v3/kv/put":
+		f.keys[decode(req["key"])] = fakeEtcdKey{value: req["value"], lease: req["lease"]}
+	case "/v3/kv/deleterange":
+		delete(f.keys, decode(req["key"]))
+	case "/v3/kv/range":
+		var kvs []map[string]string
+		for key, kv := range f.keys {
+			if strings.HasPrefix(key, decode(req["key"])) {
+				kvs = append(kvs, map[string]string{"value": kv.value})
+			}
+		}
+		resp = map[string]interface{}{"kvs": kvs}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (f *fakeEtcd) setFail(api string, fail bool) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.fail[api] = fail
+}
+
+func (f *fakeEtcd) expire(lease string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.expired[lease] = true
+	for key, kv := range f.keys {
+		if kv.lease == lease {
+			delete(f.keys, key)
+		}
+	}
+}
+
+func instanceCount(t *testing.T, e *Etcd) int {
+	instances, err := e.Instances("biz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(instances)
+}
+
+func TestEtcdRegister(t *testing.T) {
+	_, url := newFakeEtcd(t)
+	e := NewEtcd(url, "")
+	inst := Instance{ID: "biz-1", Service: "biz", Address: "127.0.0.1", Port: 8000, Tags: []string{"v1"}}
+	if err := e.Register(inst); err != nil {
+		t.Fatal(err)
+	}
+	instances, err := e.Instances("biz", "v1")
+	if err != nil || len(instances) != 1 || instances[0].ID != "biz-1" {
+		t.Fatalf("instances: %v %v", instances, err)
+	}
+	if instances, _ := e.Instances("biz", "v2"); len(instances) != 0 {
+		t.Fatalf("tag filter: %v", instances)
+	}
+	if err := e.Deregister(inst); err != nil {
+		t.Fatal(err)
+	}
+	if n := instanceCount(t, e); n != 0 {
+		t.Fatalf("%d instances after deregistration", n)
+	}
+}
+
+func TestEtcdUpdateHealthRetriesFailedCalls(t *testing.T) {
+	fake, url := newFakeEtcd(t)
+	e := NewEtcd(url, "")
+	inst := Instance{ID: "biz-1", Service: "biz", Address: "127.0.0.1", Port: 8000}
+	if err := e.Register(inst); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Deregister(inst)
+
+	fake.setFail("/v3/kv/deleterange", true)
+	if err := e.UpdateHealth(inst, false, ""); err == nil {
+		t.Fatal("failed removal reported success")
+	}
+	fake.setFail("/v3/kv/deleterange", false)
+	if err := e.UpdateHealth(inst, false, ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := instanceCount(t, e); n != 0 {
+		t.Fatalf("failing instance still registered: %d", n)
+	}
+
+	fake.setFail("/v3/kv/put", true)
+	if err := e.UpdateHealth(inst, true, ""); err == nil {
+		t.Fatal("failed restore reported success")
+	}
+	fake.setFail("/v3/kv/put", false)
+	if err := e.UpdateHealth(inst, true, ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := instanceCount(t, e); n != 1 {
+		t.Fatalf("recovered instance missing: %d", n)
+	}
+}
+
+func TestEtcdRenewsExpiredLease(t *testing.T) {
+	fake, url := newFakeEtcd(t)
+	e := NewEtcd(url, "")
+	inst := Instance{ID: "biz-1", Service: "biz", Address: "127.0.0.1", Port: 8000, Check: &Check{TTL: 300 * time.Millisecond}}
+	if err := e.Register(inst); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Deregister(inst)
+
+	fake.expire("1")
+	deadline := time.Now().Add(2 * time.Second)
+	for instanceCount(t, e) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("instance not registered again after its lease expired")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
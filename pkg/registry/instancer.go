@@ -0,0 +1,209 @@
+package registry
+
+import (
+	"context"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Instancer adapts a Registry to go-kit's sd.Instancer. It uses blocking
+// queries when the backend is a Watcher and polls every interval otherwise.
+type Instancer struct {
+	registry Registry
+	service  string
+	tags     []string
+	interval time.Duration
+	logger   log.Logger
+
+	mtx         sync.RWMutex
+	state       sd.Event
+	instances   map[string]Instance
+	observers   map[chan<- sd.Event]struct{}
+	lastSuccess time.Time
+	staleSince  time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewInstancer(registry Registry, service string, tags []string, interval time.Duration, logger log.Logger) *Instancer {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Instancer{
+		registry:  registry,
+		service:   service,
+		tags:      tags,
+		interval:  interval,
+		logger:    logger,
+		instances: make(map[string]Instance),
+		observers: make(map[chan<- sd.Event]struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+
+	instances, err := registry.Instances(service, tags...)
+	if err == nil {
+		logger.Log("service", service, "tags", tagString(tags), "instances", len(instances))
+	} else {
+		logger.Log("service", service, "tags", tagString(tags), "err", err)
+	}
+	s.update(instances, err)
+
+	go s.loop()
+	return s
+}
+
+func (s *Instancer) loop() {
+	watcher, blocking := s.registry.(Watcher)
+	var index uint64
+	for {
+		var (
+			instances []Instance
+			err       error
+		)
+		if blocking {
+			instances, index, err = watcher.Watch(s.ctx, s.service, s.tags, index)
+		} else {
+			select {
+			case <-time.After(s.interval):
+			case <-s.ctx.Done():
+			}
+			if s.ctx.Err() == nil {
+				instances, err = s.registry.Instances(s.service, s.tags...)
+			}
+		}
+
+		if s.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.logger.Log("service", s.service, "tags", tagString(s.tags), "err", err)
+			if blocking {
+				select {
+				case <-time.After(s.interval):
+				case <-s.ctx.Done():
+					return
+				}
+			}
+		}
+		s.update(instances, err)
+	}
+}
+
+func (s *Instancer) update(instances []Instance, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var event sd.Event
+	if err != nil {
+		// keep serving the last known instances, but tell observers
+		event = sd.Event{Instances: s.state.Instances, Err: err}
+		if s.staleSince.IsZero() {
+			s.staleSince = time.Now()
+		}
+	} else {
+		byAddr := make(map[string]Instance, len(instances))
+		addrs := make([]string, 0, len(instances))
+		for _, inst := range instances {
+			byAddr[inst.HostPort()] = inst
+			addrs = append(addrs, inst.HostPort())
+		}
+		sort.Strings(addrs)
+		s.instances = byAddr
+		s.lastSuccess = time.Now()
+		s.staleSince = time.Time{}
+		event = sd.Event{Instances: addrs}
+	}
+
+	if sameEvent(s.state, event) {
+		return
+	}
+	s.state = event
+	for ch := range s.observers {
+		ch <- event
+	}
+}
+
+// Instance returns the full registry entry behind an sd instance string.
+func (s *Instancer) Instance(addr string) (Instance, bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	inst, ok := s.instances[addr]
+	return inst, ok
+}
+
+// Instances returns the last known instance set.
+func (s *Instancer) Instances() []Instance {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	res := make([]Instance, 0, len(s.state.Instances))
+	for _, addr := range s.state.Instances {
+		res = append(res, s.instances[addr])
+	}
+	return res
+}
+
+// LastSuccess is when the registry last answered, zero if it never did.
+func (s *Instancer) LastSuccess() time.Time {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.lastSuccess
+}
+
+// Age is how old the served instances are: zero while queries succeed,
+// since blocking queries return as soon as anything changes, and the time
+// since the last success once the registry fails.
+func (s *Instancer) Age() time.Duration {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if s.staleSince.IsZero() {
+		return 0
+	}
+	if s.lastSuccess.IsZero() {
+		return time.Since(s.staleSince)
+	}
+	return time.Since(s.lastSuccess)
+}
+
+// Err is the error of the last registry query, nil once it recovered.
+func (s *Instancer) Err() error {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.state.Err
+}
+
+func (s *Instancer) Register(ch chan<- sd.Event) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.observers[ch] = struct{}{}
+	ch <- s.state
+}
+
+func (s *Instancer) Deregister(ch chan<- sd.Event) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.observers, ch)
+}
+
+func (s *Instancer) Stop() {
+	s.cancel()
+}
+
+func sameEvent(a, b sd.Event) bool {
+	if a.Err != b.Err || len(a.Instances) != len(b.Instances) {
+		return false
+	}
+	for i := range a.Instances {
+		if a.Instances[i] != b.Instances[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func tagString(tags []string) string {
+	return strings.Join(tags, ",")
+}
@@ -0,0 +1,155 @@
+package registry
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	sharedMtx    sync.Mutex
+	sharedMemory = make(map[string]*Memory)
+)
+
+// Memory is an in-process registry for tests and single-process setups.
+// Instances registered with a TTL check drop out unless UpdateHealth is
+// called within the TTL, mirroring Consul TTL checks.
+type Memory struct {
+	mtx      sync.Mutex
+	index    uint64
+	changed  chan struct{}
+	services map[string]map[string]*memoryEntry
+}
+
+type memoryEntry struct {
+	inst        Instance
+	passing     bool
+	maintenance bool
+	ttl         time.Duration
+	expires     time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		index:    1,
+		changed:  make(chan struct{}),
+		services: make(map[string]map[string]*memoryEntry),
+	}
+}
+
+// SharedMemory returns the process-wide registry with the given name, so
+// independently built components can find each other.
+func SharedMemory(name string) *Memory {
+	sharedMtx.Lock()
+	defer sharedMtx.Unlock()
+	m, ok := sharedMemory[name]
+	if !ok {
+		m = NewMemory()
+		sharedMemory[name] = m
+	}
+	return m
+}
+
+// notify must be called with m.mtx held.
+func (m *Memory) notify() {
+	m.index++
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+func (m *Memory) Register(inst Instance) error {
+	entry := &memoryEntry{inst: inst, passing: true}
+	if inst.Check != nil && inst.Check.TTL > 0 {
+		entry.ttl = inst.Check.TTL
+		entry.expires = time.Now().Add(entry.ttl)
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.services[inst.Service]; !ok {
+		m.services[inst.Service] = make(map[string]*memoryEntry)
+	}
+	m.services[inst.Service][inst.ID] = entry
+	m.notify()
+	return nil
+}
+
+func (m *Memory) Deregister(inst Instance) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.services[inst.Service][inst.ID]; ok {
+		delete(m.services[inst.Service], inst.ID)
+		m.notify()
+	}
+	return nil
+}
+
+func (m *Memory) UpdateHealth(inst Instance, passing bool, output string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	entry, ok := m.services[inst.Service][inst.ID]
+	if !ok {
+		return nil
+	}
+	if entry.ttl > 0 {
+		entry.expires = time.Now().Add(entry.ttl)
+	}
+	if entry.passing != passing {
+		entry.passing = passing
+		m.notify()
+	}
+	return nil
+}
+
+func (m *Memory) Maintenance(inst Instance, enable bool, reason string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	entry, ok := m.services[inst.Service][inst.ID]
+	if ok && entry.maintenance != enable {
+		entry.maintenance = enable
+		m.notify()
+	}
+	return nil
+}
+
+func (m *Memory) Instances(service string, tags ...string) ([]Instance, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.instances(service, tags), nil
+}
+
+func (m *Memory) instances(service string, tags []string) []Instance {
+	now := time.Now()
+	instances := make([]Instance, 0, len(m.services[service]))
+	for _, entry := range m.services[service] {
+		if !entry.passing || entry.maintenance {
+			continue
+		}
+		if entry.ttl > 0 && now.After(entry.expires) {
+			continue
+		}
+		instances = append(instances, entry.inst)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+	return filterTags(instances, tags)
+}
+
+// Watch blocks until the registry changes after index. TTL expiry is not an
+// event, so it also wakes up once a second to pick expired instances up.
+func (m *Memory) Watch(ctx context.Context, service string, tags []string, index uint64) ([]Instance, uint64, error) {
+	m.mtx.Lock()
+	if m.index == index {
+		changed := m.changed
+		m.mtx.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return nil, index, ctx.Err()
+		}
+		m.mtx.Lock()
+	}
+	defer m.mtx.Unlock()
+	return m.instances(service, tags), m.index, nil
+}
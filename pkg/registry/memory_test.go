@@ -0,0 +1,92 @@
+package registry
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryHealth(t *testing.T) {
+	m := NewMemory()
+	inst := Instance{ID: "biz-1", Service: "biz", Address: "127.0.0.1", Port: 8000, Tags: []string{"v1"}}
+	m.Register(inst)
+	m.Register(Instance{ID: "biz-2", Service: "biz", Address: "127.0.0.1", Port: 8001, Tags: []string{"v2"}})
+
+	if instances, _ := m.Instances("biz", "v1"); len(instances) != 1 || instances[0].ID != "biz-1" {
+		t.Fatalf("tag filter: %v", instances)
+	}
+	m.UpdateHealth(inst, false, "")
+	if instances, _ := m.Instances("biz"); len(instances) != 1 {
+		t.Fatalf("failing instance listed: %v", instances)
+	}
+	m.UpdateHealth(inst, true, "")
+	m.Maintenance(inst, true, "deploy")
+	if instances, _ := m.Instances("biz"); len(instances) != 1 {
+		t.Fatalf("instance in maintenance listed: %v", instances)
+	}
+	m.Maintenance(inst, false, "")
+	m.Deregister(inst)
+	if instances, _ := m.Instances("biz"); len(instances) != 1 || instances[0].ID != "biz-2" {
+		t.Fatalf("after deregistration: %v", instances)
+	}
+}
+
+func TestMemoryTTL(t *testing.T) {
+	m := NewMemory()
+	inst := Instance{ID: "biz-1", Service: "biz", Check: &Check{TTL: 200 * time.Millisecond}}
+	m.Register(inst)
+	time.Sleep(120 * time.Millisecond)
+	m.UpdateHealth(inst, true, "")
+	time.Sleep(120 * time.Millisecond)
+	if instances, _ := m.Instances("biz"); len(instances) != 1 {
+		t.Fatal("instance expired though its ttl was renewed")
+	}
+	time.Sleep(250 * time.Millisecond)
+	if instances, _ := m.Instances("biz"); len(instances) != 0 {
+		t.Fatal("instance kept after its ttl")
+	}
+}
+
+func TestMemoryWatch(t *testing.T) {
+	m := NewMemory()
+	_, index, err := m.Watch(context.Background(), "biz", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		m.Register(Instance{ID: "biz-1", Service: "biz"})
+	}()
+	instances, next, err := m.Watch(context.Background(), "biz", nil, index)
+	if err != nil || next == index || len(instances) != 1 {
+		t.Fatalf("watch: %v %d %v", instances, next, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := m.Watch(ctx, "biz", nil, next); err != context.Canceled {
+		t.Fatalf("cancelled watch: %v", err)
+	}
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "instances.json")
+	os.WriteFile(path, []byte(`{"biz": [{"address": "127.0.0.1", "port": 8000, "tags": ["v1"]}, {"id": "biz-2", "address": "127.0.0.1", "port": 8001}]}`), 0644)
+
+	f := NewFile(path)
+	instances, err := f.Instances("biz")
+	if err != nil || len(instances) != 2 {
+		t.Fatalf("instances: %v %v", instances, err)
+	}
+	if instances[0].ID != "127.0.0.1:8000" || instances[0].Service != "biz" || instances[1].ID != "biz-2" {
+		t.Fatalf("defaults: %+v", instances)
+	}
+	if instances, _ := f.Instances("biz", "v1"); len(instances) != 1 {
+		t.Fatalf("tag filter: %v", instances)
+	}
+	if err := f.Register(instances[0]); err != ErrReadOnly {
+		t.Fatalf("register: %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/consul/api"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrReadOnly       = errors.New("registry backend is read-only")
+	ErrUnknownBackend = errors.New("registry has 5 backends: consul, etcd, file, dns and memory")
+)
+
+type Instance struct {
+	ID      string            `json:"id"`
+	Service string            `json:"service"`
+	Address string            `json:"address"`
+	Port    int               `json:"port"`
+	Tags    []string          `json:"tags,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+	Weight  int               `json:"weight,omitempty"`
+	Check   *Check            `json:"-"`
+}
+
+// Check describes how the backend decides the instance is alive. Backends
+// without active checking only honour TTL.
+type Check struct {
+	HTTP            string
+	Interval        time.Duration
+	Timeout         time.Duration
+	TTL             time.Duration
+	DeregisterAfter time.Duration
+	Notes           string
+	// TLSSkipVerify accepts any certificate on an https check.
+	TLSSkipVerify bool
+}
+
+func (i Instance) HostPort() string {
+	return net.JoinHostPort(i.Address, strconv.Itoa(i.Port))
+}
+
+func (i Instance) HasTags(tags []string) bool {
+	for _, want := range tags {
+		found := false
+		for _, tag := range i.Tags {
+			if tag == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Registry is implemented by every discovery backend. Instances only returns
+// instances considered healthy by the backend.
+type Registry interface {
+	Register(inst Instance) error
+	Deregister(inst Instance) error
+	Instances(service string, tags ...string) ([]Instance, error)
+}
+
+// Watcher is implemented by backends supporting blocking queries. Watch
+// returns once the instance set differs from index or ctx is done.
+type Watcher interface {
+	Watch(ctx context.Context, service string, tags []string, index uint64) ([]Instance, uint64, error)
+}
+
+// HealthUpdater is implemented by backends where the instance reports its
+// own health, e.g. Consul TTL checks or etcd leases.
+type HealthUpdater interface {
+	UpdateHealth(inst Instance, passing bool, output string) error
+}
+
+// Maintainer is implemented by backends that can take an instance out of
+// rotation without deregistering it.
+type Maintainer interface {
+	Maintenance(inst Instance, enable bool, reason string) error
+}
+
+// New builds a registry from a URL:
+//
+//	consul://127.0.0.1:8500
+//	etcd://127.0.0.1:2379/services
+//	file:///etc/biz/instances.json
+//	dns:///service.consul
+//	memory://dev
+func New(rawurl string) (Registry, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "consul":
+		consulCfg := api.DefaultConfig()
+		consulCfg.Address = u.Host
+		client, err := api.NewClient(consulCfg)
+		if err != nil {
+			return nil, err
+		}
+		return NewConsul(client), nil
+	case "etcd":
+		return NewEtcd("http://"+u.Host, u.Path), nil
+	case "file":
+		return NewFile(u.Path), nil
+	case "dns":
+		return NewDNSSRV(strings.TrimPrefix(u.Path, "/")), nil
+	case "memory":
+		return SharedMemory(u.Host), nil
+	}
+	return nil, fmt.Errorf("%v: %q", ErrUnknownBackend, u.Scheme)
+}
+
+func filterTags(instances []Instance, tags []string) []Instance {
+	if len(tags) == 0 {
+		return instances
+	}
+	res := make([]Instance, 0, len(instances))
+	for _, inst := range instances {
+		if inst.HasTags(tags) {
+			res = append(res, inst)
+		}
+	}
+	return res
+}
@@ -0,0 +1,87 @@
+package registry
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+)
+
+// File reads instances from a JSON file keyed by service name:
+//
+//	{"biz": [{"id": "biz-1", "address": "127.0.0.1", "port": 8000}]}
+//
+// The file is read on every lookup so edits apply without a restart.
+type File struct {
+	path string
+}
+
+func NewFile(path string) *File {
+	return &File{path: path}
+}
+
+func (f *File) Register(inst Instance) error {
+	return ErrReadOnly
+}
+
+func (f *File) Deregister(inst Instance) error {
+	return ErrReadOnly
+}
+
+func (f *File) Instances(service string, tags ...string) ([]Instance, error) {
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	services := make(map[string][]Instance)
+	if err := json.Unmarshal(b, &services); err != nil {
+		return nil, err
+	}
+
+	instances := services[service]
+	for i := range instances {
+		instances[i].Service = service
+		if instances[i].ID == "" {
+			instances[i].ID = instances[i].HostPort()
+		}
+	}
+	return filterTags(instances, tags), nil
+}
+
+// DNSSRV resolves _service._tcp.domain SRV records. Tags are not supported
+// by DNS and are ignored.
+type DNSSRV struct {
+	domain string
+}
+
+func NewDNSSRV(domain string) *DNSSRV {
+	return &DNSSRV{domain: domain}
+}
+
+func (d *DNSSRV) Register(inst Instance) error {
+	return ErrReadOnly
+}
+
+func (d *DNSSRV) Deregister(inst Instance) error {
+	return ErrReadOnly
+}
+
+func (d *DNSSRV) Instances(service string, tags ...string) ([]Instance, error) {
+	_, addrs, err := net.LookupSRV(service, "tcp", d.domain)
+	if err != nil {
+		return nil, err
+	}
+
+	instances := make([]Instance, 0, len(addrs))
+	for _, addr := range addrs {
+		inst := Instance{
+			Service: service,
+			Address: strings.TrimSuffix(addr.Target, "."),
+			Port:    int(addr.Port),
+			Weight:  int(addr.Weight),
+		}
+		inst.ID = inst.HostPort()
+		instances = append(instances, inst)
+	}
+	return instances, nil
+}
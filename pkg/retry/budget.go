@@ -0,0 +1,82 @@
+package retry
+
+import (
+	"sync"
+	"time"
+)
+
+const budgetBuckets = 10
+
+type budgetBucket struct {
+	start    time.Time
+	requests int
+	retries  int
+}
+
+// Budget caps retries and hedges at ratio of the requests seen during the
+// last window, plus minPerSecond so low traffic can still retry at all.
+// A nil Budget allows every retry.
+type Budget struct {
+	ratio        float64
+	minPerSecond float64
+	window       time.Duration
+
+	mtx     sync.Mutex
+	buckets [budgetBuckets]budgetBucket
+}
+
+func NewBudget(ratio float64, minPerSecond int, window time.Duration) *Budget {
+	if window <= 0 {
+		window = 10 * time.Second
+	}
+	return &Budget{
+		ratio:        ratio,
+		minPerSecond: float64(minPerSecond),
+		window:       window,
+	}
+}
+
+// Request records a first attempt.
+func (b *Budget) Request() {
+	if b == nil {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.current(time.Now()).requests++
+}
+
+// Withdraw reports whether a retry is allowed and, if so, counts it.
+func (b *Budget) Withdraw() bool {
+	if b == nil {
+		return true
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	now := time.Now()
+	cur := b.current(now)
+	var requests, retries int
+	for _, bucket := range b.buckets {
+		if now.Sub(bucket.start) < b.window {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+	allowed := b.ratio*float64(requests) + b.minPerSecond*b.window.Seconds()
+	if float64(retries+1) > allowed {
+		return false
+	}
+	cur.retries++
+	return true
+}
+
+func (b *Budget) current(now time.Time) *budgetBucket {
+	width := b.window / budgetBuckets
+	start := now.Truncate(width)
+	bucket := &b.buckets[int(start.UnixNano()/int64(width))%budgetBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = budgetBucket{start: start}
+	}
+	return bucket
+}
@@ -0,0 +1,28 @@
+package retry
+
+import (
+	"context"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/sd/lb"
+	"go-kit-one/pkg/balancer"
+	"time"
+)
+
+// Endpoint replaces lb.Retry: every attempt gets an endpoint from b and the
+// whole call, retries and hedges included, has to finish within timeout.
+// Attempts avoid instances the call already tried while others are left.
+// Calls that mustn't run twice take p.NonIdempotent().
+func Endpoint(p Policy, b lb.Balancer, timeout time.Duration) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		ctx, cancel := context.WithTimeout(balancer.WithTried(ctx), timeout)
+		defer cancel()
+
+		return p.Do(ctx, func(ctx context.Context) (interface{}, error) {
+			e, err := b.Endpoint()
+			if err != nil {
+				return nil, err
+			}
+			return e(ctx, request)
+		}, nil)
+	}
+}
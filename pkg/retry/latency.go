@@ -0,0 +1,65 @@
+package retry
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	latencySamples    = 512
+	latencyMinSamples = 50
+	latencyRefresh    = time.Second
+)
+
+// LatencyTracker keeps the most recent call latencies so hedging can wait
+// for a percentile instead of a fixed delay. A nil tracker observes nothing.
+type LatencyTracker struct {
+	mtx     sync.Mutex
+	samples []time.Duration
+	next    int
+
+	sorted   []time.Duration
+	sortedAt time.Time
+}
+
+func NewLatencyTracker() *LatencyTracker {
+	return &LatencyTracker{samples: make([]time.Duration, 0, latencySamples)}
+}
+
+func (t *LatencyTracker) Observe(d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if len(t.samples) < latencySamples {
+		t.samples = append(t.samples, d)
+		return
+	}
+	t.samples[t.next] = d
+	t.next = (t.next + 1) % latencySamples
+}
+
+// Percentile returns the p-th percentile, 0 < p < 1, and false until enough
+// samples were seen. The sorted copy is refreshed at most once a second.
+func (t *LatencyTracker) Percentile(p float64) (time.Duration, bool) {
+	if t == nil {
+		return 0, false
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if len(t.samples) < latencyMinSamples {
+		return 0, false
+	}
+	if time.Since(t.sortedAt) > latencyRefresh {
+		t.sorted = append(t.sorted[:0], t.samples...)
+		sort.Slice(t.sorted, func(i, j int) bool { return t.sorted[i] < t.sorted[j] })
+		t.sortedAt = time.Now()
+	}
+	idx := int(p * float64(len(t.sorted)))
+	if idx >= len(t.sorted) {
+		idx = len(t.sorted) - 1
+	}
+	return t.sorted[idx], true
+}
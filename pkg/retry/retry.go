@@ -0,0 +1,214 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"github.com/go-kit/kit/sd/lb"
+	"go-kit-one/pkg/balancer"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Policy decides whether, when and how often a failed call is tried again.
+// The zero value makes a single attempt.
+type Policy struct {
+	// Attempts is the total number of attempts, including the first one.
+	Attempts int
+	// Backoff before retry n is drawn uniformly from [0, min(MaxBackoff, BaseBackoff*2^n)].
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// Budget is shared by every caller so retries stay a fraction of traffic.
+	Budget *Budget
+	// Retryable classifies errors, defaults to IsRetryable.
+	Retryable func(err error) bool
+	// HedgePercentile sends a second request to another instance once the
+	// first one is slower than this percentile of recent latencies, e.g. 0.95.
+	// Hedges are paid from the budget. Zero disables hedging.
+	HedgePercentile float64
+	Latency         *LatencyTracker
+}
+
+// IsRetryable treats connection failures, timeouts of a single attempt,
+// missing instances and 429/502/503/504 responses as worth another try.
+// Other errors, and any error after the caller gave up, are final.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var se balancer.StatusError
+	if errors.As(err, &se) {
+		switch se.Code {
+		case 429, 502, 503, 504:
+			return true
+		}
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, balancer.ErrNoInstances) || errors.Is(err, lb.ErrNoEndpoints) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// NotSent reports whether err proves the request never reached an instance:
+// there was none to send it to, or no connection could be made.
+func NotSent(err error) bool {
+	if errors.Is(err, balancer.ErrNoInstances) || errors.Is(err, lb.ErrNoEndpoints) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// NonIdempotent is p for requests that mustn't run twice: they are only
+// retried when they weren't sent, and never hedged.
+func (p Policy) NonIdempotent() Policy {
+	p.Retryable = NotSent
+	p.HedgePercentile = 0
+	return p
+}
+
+func (p Policy) Backoff(retry int) time.Duration {
+	if p.BaseBackoff <= 0 {
+		return 0
+	}
+	backoff := p.BaseBackoff << uint(retry)
+	if retry >= 63 || backoff <= 0 || backoff>>uint(retry) != p.BaseBackoff {
+		// overflowed, the bound Int63n can still take
+		backoff = math.MaxInt64 - 1
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+func (p Policy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+func (p Policy) hedgeDelay() (time.Duration, bool) {
+	if p.HedgePercentile <= 0 || p.Latency == nil {
+		return 0, false
+	}
+	return p.Latency.Percentile(p.HedgePercentile)
+}
+
+// Call is a single attempt. It may return a result together with an error,
+// e.g. a 503 response, which is handed back as is when no retry is left.
+type Call func(ctx context.Context) (interface{}, error)
+
+// Do runs call under the policy and returns the first success or the last
+// failure. discard releases results that are not handed back to the caller,
+// such as losing hedges or failed responses before a retry; it may be nil.
+func (p Policy) Do(ctx context.Context, call Call, discard func(interface{})) (interface{}, error) {
+	if discard == nil {
+		discard = func(interface{}) {}
+	}
+	p.Budget.Request()
+
+	for attempt := 1; ; attempt++ {
+		res, err := p.attempt(ctx, call, discard)
+		if err == nil || attempt >= p.Attempts || ctx.Err() != nil || !p.retryable(err) || !p.Budget.Withdraw() {
+			return res, err
+		}
+		if res != nil {
+			discard(res)
+		}
+		select {
+		case <-time.After(p.Backoff(attempt - 1)):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+type result struct {
+	res interface{}
+	err error
+	idx int
+}
+
+// attempt runs call, hedging it with a second concurrent call when the first
+// one takes longer than the hedge delay.
+func (p Policy) attempt(ctx context.Context, call Call, discard func(interface{})) (interface{}, error) {
+	delay, hedge := p.hedgeDelay()
+	if !hedge {
+		begin := time.Now()
+		res, err := call(ctx)
+		p.Latency.Observe(time.Since(begin))
+		return res, err
+	}
+
+	var (
+		mtx     sync.Mutex
+		cancels []context.CancelFunc
+		results = make(chan result, 2)
+	)
+	launch := func() {
+		callCtx, cancel := context.WithCancel(ctx)
+		mtx.Lock()
+		idx := len(cancels)
+		cancels = append(cancels, cancel)
+		mtx.Unlock()
+		go func() {
+			begin := time.Now()
+			res, err := call(callCtx)
+			p.Latency.Observe(time.Since(begin))
+			results <- result{res, err, idx}
+		}()
+	}
+
+	launch()
+	inflight := 1
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var last result
+	for inflight > 0 {
+		select {
+		case <-timer.C:
+			if p.Budget.Withdraw() {
+				launch()
+				inflight++
+			}
+		case r := <-results:
+			inflight--
+			if r.err == nil {
+				if inflight > 0 {
+					// the loser is cancelled and its result dropped once it
+					// comes back; the winner keeps its context alive since its
+					// result may still be read from, e.g. a response body
+					mtx.Lock()
+					for i, cancel := range cancels {
+						if i != r.idx {
+							cancel()
+						}
+					}
+					mtx.Unlock()
+					go func() {
+						if l := <-results; l.res != nil {
+							discard(l.res)
+						}
+					}()
+				}
+				// an earlier failure may carry a response, e.g. a 503
+				if last.res != nil {
+					discard(last.res)
+				}
+				return r.res, nil
+			}
+			if last.res != nil {
+				discard(last.res)
+			}
+			last = r
+		}
+	}
+	return last.res, last.err
+}
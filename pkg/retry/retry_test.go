@@ -0,0 +1,120 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"go-kit-one/pkg/balancer"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	p := Policy{BaseBackoff: 10 * time.Millisecond, MaxBackoff: time.Second}
+	for retry := 0; retry < 100; retry++ {
+		limit := 10 * time.Millisecond << uint(retry)
+		if retry >= 7 {
+			limit = time.Second
+		}
+		for i := 0; i < 20; i++ {
+			if d := p.Backoff(retry); d < 0 || d > limit {
+				t.Fatalf("backoff %d: %v not in [0, %v]", retry, d, limit)
+			}
+		}
+	}
+
+	if d := (Policy{}).Backoff(3); d != 0 {
+		t.Fatalf("backoff without base: %v", d)
+	}
+
+	// without a max the shift overflows for late retries
+	p = Policy{BaseBackoff: time.Second}
+	for _, retry := range []int{33, 34, 40, 62, 63, 64, 1000} {
+		if d := p.Backoff(retry); d < 0 {
+			t.Fatalf("backoff %d without max: %v", retry, d)
+		}
+	}
+}
+
+func TestBudget(t *testing.T) {
+	b := NewBudget(0.2, 0, 10*time.Second)
+	for i := 0; i < 10; i++ {
+		b.Request()
+	}
+	if !b.Withdraw() || !b.Withdraw() {
+		t.Fatal("20% of 10 requests refused")
+	}
+	if b.Withdraw() {
+		t.Fatal("third retry of 10 requests allowed")
+	}
+
+	// the minimum lets low traffic retry
+	b = NewBudget(0.2, 1, time.Second)
+	if !b.Withdraw() {
+		t.Fatal("retry refused under the minimum")
+	}
+	if b.Withdraw() {
+		t.Fatal("retry beyond the minimum allowed")
+	}
+
+	var nilBudget *Budget
+	nilBudget.Request()
+	if !nilBudget.Withdraw() {
+		t.Fatal("nil budget refused a retry")
+	}
+}
+
+func TestDoRetries(t *testing.T) {
+	unavailable := balancer.StatusError{Code: 503, Err: errors.New("503 Service Unavailable")}
+	for _, tc := range []struct {
+		name   string
+		policy Policy
+		err    error
+		calls  int32
+	}{
+		{"retryable", Policy{Attempts: 3}, unavailable, 3},
+		{"final", Policy{Attempts: 3}, balancer.StatusError{Code: 400, Err: errors.New("400 Bad Request")}, 1},
+		{"budget", Policy{Attempts: 3, Budget: NewBudget(0, 0, time.Second)}, unavailable, 1},
+		{"non-idempotent sent", Policy{Attempts: 3}.NonIdempotent(), unavailable, 1},
+		{"non-idempotent not sent", Policy{Attempts: 3}.NonIdempotent(), &net.OpError{Op: "dial", Err: errors.New("connection refused")}, 3},
+	} {
+		var calls int32
+		_, err := tc.policy.Do(context.Background(), func(ctx context.Context) (interface{}, error) {
+			atomic.AddInt32(&calls, 1)
+			return nil, tc.err
+		}, nil)
+		if err != tc.err || calls != tc.calls {
+			t.Errorf("%s: %d calls, %v", tc.name, calls, err)
+		}
+	}
+}
+
+func TestHedgeDiscardsLoser(t *testing.T) {
+	latency := NewLatencyTracker()
+	for i := 0; i < latencyMinSamples; i++ {
+		latency.Observe(time.Millisecond)
+	}
+	p := Policy{Attempts: 1, HedgePercentile: 0.5, Latency: latency}
+
+	var calls int32
+	discarded := make(chan interface{}, 2)
+	res, err := p.Do(context.Background(), func(ctx context.Context) (interface{}, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-ctx.Done()
+			return "slow", ctx.Err()
+		}
+		return "fast", nil
+	}, func(res interface{}) { discarded <- res })
+	if err != nil || res != "fast" {
+		t.Fatalf("got %v %v", res, err)
+	}
+	select {
+	case res := <-discarded:
+		if res != "slow" {
+			t.Fatalf("discarded %v", res)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("losing hedge not discarded")
+	}
+}
@@ -0,0 +1,52 @@
+package route
+
+import (
+	"strings"
+	"time"
+)
+
+// Cache lets the gateway answer a route from its response cache. TTL applies
+// to responses without max-age or s-maxage; an upstream Cache-Control always
+// wins, and no-store, no-cache or private keep a response out of the cache.
+// Only GET and HEAD are cached unless Methods says otherwise, other methods
+// are keyed by their body too. Responses to requests carrying credentials
+// are only shared when the upstream marks them public, or with Auth for
+// routes whose answers don't depend on the user.
+type Cache struct {
+	TTL     string   `json:"ttl,omitempty"`
+	Methods []string `json:"methods,omitempty"`
+	Auth    bool     `json:"auth,omitempty"`
+
+	ttl time.Duration
+}
+
+func (c *Cache) compile() error {
+	if c.TTL != "" {
+		ttl, err := time.ParseDuration(c.TTL)
+		if err != nil {
+			return err
+		}
+		c.ttl = ttl
+	}
+	if len(c.Methods) == 0 {
+		c.Methods = []string{"GET", "HEAD"}
+	}
+	for i, m := range c.Methods {
+		c.Methods[i] = strings.ToUpper(m)
+	}
+	return nil
+}
+
+func (c *Cache) TTLDuration() time.Duration {
+	return c.ttl
+}
+
+// Cacheable reports whether requests with method may be cached.
+func (c *Cache) Cacheable(method string) bool {
+	for _, m := range c.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
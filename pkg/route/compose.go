@@ -0,0 +1,194 @@
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoParts      = errors.New("compose needs at least one part")
+	ErrPartName     = errors.New("compose parts need distinct names")
+	ErrPartService  = errors.New("compose part needs a service and a path")
+	ErrComposeMixed = errors.New("compose can't be combined with service, rewrite, split or mirror")
+	ErrTemplateRef  = errors.New("compose template refers to an unknown part")
+	ErrTemplatePath = errors.New("compose template path doesn't exist in the part's response")
+)
+
+// Part is one upstream call of a composition route. With path_regex, path
+// may refer to the route's capture groups as $1. A failing part answers
+// with Fallback when set, with null when Optional, and fails the whole
+// request otherwise.
+type Part struct {
+	Name     string          `json:"name"`
+	Service  string          `json:"service"`
+	Method   string          `json:"method,omitempty"`
+	Path     string          `json:"path"`
+	Timeout  string          `json:"timeout,omitempty"`
+	Fallback json.RawMessage `json:"fallback,omitempty"`
+	Optional bool            `json:"optional,omitempty"`
+
+	timeout  time.Duration
+	fallback interface{}
+}
+
+func (p *Part) TimeoutDuration() time.Duration {
+	return p.timeout
+}
+
+// FallbackValue is the decoded Fallback, nil without one.
+func (p *Part) FallbackValue() (interface{}, bool) {
+	return p.fallback, p.Fallback != nil
+}
+
+// Compose fans a request out to all Parts in parallel and merges their JSON
+// responses by Template, a JSON document whose strings "$name" or
+// "$name.field.0" are replaced by a part's response or a value inside it.
+// Without a template the responses are returned keyed by part name.
+type Compose struct {
+	Parts    []*Part         `json:"parts"`
+	Template json.RawMessage `json:"template,omitempty"`
+
+	template interface{}
+}
+
+func (c *Compose) compile(timeout time.Duration) error {
+	if len(c.Parts) == 0 {
+		return ErrNoParts
+	}
+	names := make(map[string]bool)
+	for _, p := range c.Parts {
+		if p.Name == "" || names[p.Name] {
+			return fmt.Errorf("%v: %q", ErrPartName, p.Name)
+		}
+		names[p.Name] = true
+		if p.Service == "" || p.Path == "" {
+			return fmt.Errorf("%v: %q", ErrPartService, p.Name)
+		}
+		if p.Method == "" {
+			p.Method = "GET"
+		}
+		p.Method = strings.ToUpper(p.Method)
+		p.timeout = timeout
+		if p.Timeout != "" {
+			t, err := time.ParseDuration(p.Timeout)
+			if err != nil {
+				return err
+			}
+			p.timeout = t
+		}
+		if p.Fallback != nil {
+			if err := json.Unmarshal(p.Fallback, &p.fallback); err != nil {
+				return fmt.Errorf("part %s fallback: %v", p.Name, err)
+			}
+		}
+	}
+
+	if c.Template == nil {
+		return nil
+	}
+	if err := json.Unmarshal(c.Template, &c.template); err != nil {
+		return fmt.Errorf("template: %v", err)
+	}
+	return checkRefs(c.template, names)
+}
+
+func checkRefs(tpl interface{}, names map[string]bool) error {
+	switch t := tpl.(type) {
+	case string:
+		if name, _, ok := ref(t); ok && !names[name] {
+			return fmt.Errorf("%v: %q", ErrTemplateRef, t)
+		}
+	case map[string]interface{}:
+		for _, v := range t {
+			if err := checkRefs(v, names); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, v := range t {
+			if err := checkRefs(v, names); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ref splits "$name.a.b" into the part name and the path inside it.
+func ref(s string) (string, []string, bool) {
+	if !strings.HasPrefix(s, "$") || len(s) == 1 {
+		return "", nil, false
+	}
+	segments := strings.Split(s[1:], ".")
+	return segments[0], segments[1:], true
+}
+
+// Render merges the part responses, keyed by part name, into one document.
+func (c *Compose) Render(results map[string]interface{}) (interface{}, error) {
+	if c.template == nil {
+		doc := make(map[string]interface{}, len(results))
+		for name, v := range results {
+			doc[name] = v
+		}
+		return doc, nil
+	}
+	return render(c.template, results)
+}
+
+func render(tpl interface{}, results map[string]interface{}) (interface{}, error) {
+	switch t := tpl.(type) {
+	case string:
+		name, path, ok := ref(t)
+		if !ok {
+			return t, nil
+		}
+		return lookup(results[name], path)
+	case map[string]interface{}:
+		doc := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			rv, err := render(v, results)
+			if err != nil {
+				return nil, err
+			}
+			doc[k] = rv
+		}
+		return doc, nil
+	case []interface{}:
+		doc := make([]interface{}, len(t))
+		for i, v := range t {
+			rv, err := render(v, results)
+			if err != nil {
+				return nil, err
+			}
+			doc[i] = rv
+		}
+		return doc, nil
+	}
+	return tpl, nil
+}
+
+// lookup walks path through objects and arrays. A null anywhere on the way,
+// e.g. an optional part that failed, gives null.
+func lookup(v interface{}, path []string) (interface{}, error) {
+	for _, seg := range path {
+		switch t := v.(type) {
+		case nil:
+			return nil, nil
+		case map[string]interface{}:
+			v = t[seg]
+		case []interface{}:
+			i, err := strconv.Atoi(seg)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil, fmt.Errorf("%v: %q", ErrTemplatePath, seg)
+			}
+			v = t[i]
+		default:
+			return nil, fmt.Errorf("%v: %q", ErrTemplatePath, seg)
+		}
+	}
+	return v, nil
+}
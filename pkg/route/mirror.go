@@ -0,0 +1,41 @@
+package route
+
+import "errors"
+
+var (
+	ErrMirrorService = errors.New("mirror needs a service")
+	ErrMirrorPercent = errors.New("mirror percent must be between 0 and 100")
+)
+
+// Mirror copies a percentage of a route's requests to a shadow service,
+// optionally restricted to instances with Tags. Shadow responses never
+// reach the client; with Compare they are checked against the primary
+// response. Without a percent every request is mirrored, a percent of 0
+// pauses mirroring.
+type Mirror struct {
+	Service string   `json:"service"`
+	Tags    []string `json:"tags,omitempty"`
+	Percent *float64 `json:"percent,omitempty"`
+	Compare bool     `json:"compare,omitempty"`
+
+	percent float64
+}
+
+func (m *Mirror) compile() error {
+	if m.Service == "" {
+		return ErrMirrorService
+	}
+	m.percent = 100
+	if m.Percent != nil {
+		if *m.Percent < 0 || *m.Percent > 100 {
+			return ErrMirrorPercent
+		}
+		m.percent = *m.Percent
+	}
+	return nil
+}
+
+// MirroredPercent is the percentage of requests mirrored.
+func (m *Mirror) MirroredPercent() float64 {
+	return m.percent
+}
@@ -0,0 +1,37 @@
+package route
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMirrorPercent(t *testing.T) {
+	for _, tc := range []struct {
+		percent string
+		want    float64
+		err     error
+	}{
+		{"", 100, nil},
+		{`, "percent": 0`, 0, nil},
+		{`, "percent": 10`, 10, nil},
+		{`, "percent": 100`, 100, nil},
+		{`, "percent": -1`, 0, ErrMirrorPercent},
+		{`, "percent": 101`, 0, ErrMirrorPercent},
+	} {
+		table, err := Parse([]byte(fmt.Sprintf(`{"routes": [{"path_prefix": "/calc/", "service": "biz",
+			"mirror": {"service": "shadow"%s}}]}`, tc.percent)))
+		if tc.err != nil {
+			if err == nil {
+				t.Errorf("percent%s: no error", tc.percent)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("percent%s: %v", tc.percent, err)
+			continue
+		}
+		if got := table.Routes[0].Mirror.MirroredPercent(); got != tc.want {
+			t.Errorf("percent%s: mirrors %v%%, want %v%%", tc.percent, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-kit-one/pkg/plugin"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const DefaultTimeout = time.Second
+
+var (
+	ErrNoService = errors.New("route needs a service")
+	ErrNoMatcher = errors.New("route needs either path_prefix or path_regex")
+)
+
+// Route maps matching requests to an upstream service. Every set field has
+// to match: host ("api.example.com" or "*.example.com"), path prefix or
+// regex, method and headers (an empty value only requires the header).
+//
+// With path_regex, service and rewrite may refer to capture groups as $1.
+// With path_prefix, rewrite replaces the prefix. Without rewrite the path
+// is forwarded unchanged.
+//
+// Split divides the traffic between versions of the service and Mirror
+// copies it to a shadow service, see Split and Mirror. A Compose route has
+// no service of its own and answers from several upstream calls instead.
+// Cache answers repeated requests from the gateway, see Cache. Plugins
+// transform the requests and responses of the route, in order. Stream
+// limits its WebSocket and Server-Sent Events connections.
+type Route struct {
+	Name       string            `json:"name"`
+	Host       string            `json:"host,omitempty"`
+	PathPrefix string            `json:"path_prefix,omitempty"`
+	PathRegex  string            `json:"path_regex,omitempty"`
+	Methods    []string          `json:"methods,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Service    string            `json:"service"`
+	Rewrite    *string           `json:"rewrite,omitempty"`
+	Timeout    string            `json:"timeout,omitempty"`
+	Auth       bool              `json:"auth,omitempty"`
+	Split      *Split            `json:"split,omitempty"`
+	Mirror     *Mirror           `json:"mirror,omitempty"`
+	Compose    *Compose          `json:"compose,omitempty"`
+	Cache      *Cache            `json:"cache,omitempty"`
+	Plugins    []plugin.Config   `json:"plugins,omitempty"`
+	Stream     *Stream           `json:"stream,omitempty"`
+
+	regex   *regexp.Regexp
+	timeout time.Duration
+	plugins plugin.Chain
+}
+
+func (r *Route) compile() error {
+	if r.Compose != nil {
+		if r.Service != "" || r.Rewrite != nil || r.Split != nil || r.Mirror != nil {
+			return ErrComposeMixed
+		}
+	} else if r.Service == "" {
+		return ErrNoService
+	}
+	if (r.PathPrefix == "") == (r.PathRegex == "") {
+		return ErrNoMatcher
+	}
+	if r.PathRegex != "" {
+		regex, err := regexp.Compile(r.PathRegex)
+		if err != nil {
+			return err
+		}
+		r.regex = regex
+	}
+	r.timeout = DefaultTimeout
+	if r.Timeout != "" {
+		timeout, err := time.ParseDuration(r.Timeout)
+		if err != nil {
+			return err
+		}
+		r.timeout = timeout
+	}
+	if r.Split != nil {
+		if err := r.Split.compile(); err != nil {
+			return fmt.Errorf("split: %v", err)
+		}
+	}
+	if r.Mirror != nil {
+		if err := r.Mirror.compile(); err != nil {
+			return fmt.Errorf("mirror: %v", err)
+		}
+	}
+	if r.Compose != nil {
+		if err := r.Compose.compile(r.timeout); err != nil {
+			return fmt.Errorf("compose: %v", err)
+		}
+	}
+	if r.Cache != nil {
+		if err := r.Cache.compile(); err != nil {
+			return fmt.Errorf("cache: %v", err)
+		}
+	}
+	if r.Stream != nil {
+		if err := r.Stream.compile(); err != nil {
+			return fmt.Errorf("stream: %v", err)
+		}
+	}
+	plugins, err := plugin.NewChain(r.Plugins)
+	if err != nil {
+		return err
+	}
+	r.plugins = plugins
+	for i, m := range r.Methods {
+		r.Methods[i] = strings.ToUpper(m)
+	}
+	if r.Name == "" {
+		service := r.Service
+		if r.Compose != nil {
+			service = "compose"
+		}
+		r.Name = service + ":" + r.PathPrefix + r.PathRegex
+	}
+	return nil
+}
+
+func (r *Route) TimeoutDuration() time.Duration {
+	return r.timeout
+}
+
+// StreamLimits returns the route's stream limits, the defaults without any.
+func (r *Route) StreamLimits() *Stream {
+	if r.Stream == nil {
+		return defaultStream
+	}
+	return r.Stream
+}
+
+func (r *Route) PluginChain() plugin.Chain {
+	return r.plugins
+}
+
+// Match is a request matched to a route, with the service and the upstream
+// path resolved. Compose routes get the path of every part in PartPaths
+// instead.
+type Match struct {
+	Route     *Route
+	Service   string
+	Path      string
+	PartPaths []string
+}
+
+func (r *Route) match(req *http.Request) (Match, bool) {
+	if r.Host != "" && !matchHost(r.Host, req.Host) {
+		return Match{}, false
+	}
+	if len(r.Methods) > 0 {
+		found := false
+		for _, m := range r.Methods {
+			if m == req.Method {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return Match{}, false
+		}
+	}
+	for name, want := range r.Headers {
+		got := req.Header.Get(name)
+		if got == "" || (want != "" && got != want) {
+			return Match{}, false
+		}
+	}
+
+	path := req.URL.Path
+	m := Match{Route: r, Service: r.Service, Path: path}
+	if r.regex != nil {
+		groups := r.regex.FindStringSubmatchIndex(path)
+		if groups == nil {
+			return Match{}, false
+		}
+		m.Service = string(r.regex.ExpandString(nil, r.Service, path, groups))
+		if r.Rewrite != nil {
+			m.Path = string(r.regex.ExpandString(nil, *r.Rewrite, path, groups))
+		}
+		if r.Compose != nil {
+			for _, p := range r.Compose.Parts {
+				m.PartPaths = append(m.PartPaths, string(r.regex.ExpandString(nil, p.Path, path, groups)))
+			}
+		}
+	} else {
+		if !hasPathPrefix(path, r.PathPrefix) {
+			return Match{}, false
+		}
+		if r.Rewrite != nil {
+			m.Path = *r.Rewrite + strings.TrimPrefix(path, r.PathPrefix)
+		}
+		if r.Compose != nil {
+			for _, p := range r.Compose.Parts {
+				m.PartPaths = append(m.PartPaths, p.Path)
+			}
+		}
+	}
+	if r.Compose != nil {
+		return m, true
+	}
+	if m.Service == "" {
+		return Match{}, false
+	}
+	if !strings.HasPrefix(m.Path, "/") {
+		m.Path = "/" + m.Path
+	}
+	return m, true
+}
+
+// hasPathPrefix reports whether prefix is a whole-segment prefix of path:
+// /v1/login matches /v1/login and /v1/login/x but not /v1/loginAdmin.
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+func matchHost(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return strings.EqualFold(pattern, host)
+}
+
+// Table holds the routes in the order they are tried.
+type Table struct {
+	Routes []*Route `json:"routes"`
+}
+
+// Default is the routing the gateway had before route tables: the first
+// path segment names the service and is stripped, /biz/add/1/2 goes to
+// service biz as /add/1/2.
+func Default() *Table {
+	rewrite := "$2"
+	t := &Table{Routes: []*Route{{
+		Name:      "default",
+		PathRegex: `^/([^/]+)(/.*)?$`,
+		Service:   "$1",
+		Rewrite:   &rewrite,
+	}}}
+	t.Routes[0].compile()
+	return t
+}
+
+func Parse(data []byte) (*Table, error) {
+	t := &Table{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, err
+	}
+	for i, r := range t.Routes {
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("route %d (%s): %v", i, r.Name, err)
+		}
+	}
+	return t, nil
+}
+
+func Load(path string) (*Table, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Match returns the first route matching req.
+func (t *Table) Match(req *http.Request) (Match, bool) {
+	for _, r := range t.Routes {
+		if m, ok := r.match(req); ok {
+			return m, true
+		}
+	}
+	return Match{}, false
+}
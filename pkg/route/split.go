@@ -0,0 +1,135 @@
+package route
+
+import (
+	"errors"
+	"fmt"
+	"go-kit-one/pkg/balancer"
+	"go-kit-one/pkg/registry"
+	"hash/crc32"
+	"math/rand"
+	"net/http"
+)
+
+var (
+	ErrNoVersions    = errors.New("split needs at least one version")
+	ErrVersionName   = errors.New("split versions need distinct names")
+	ErrNoSplitWeight = errors.New("split needs a version with a positive weight")
+)
+
+// Version is the subset of a service's instances carrying all of Tags and
+// all of the Meta pairs, e.g. tags ["v2"] or meta {"version": "v2"}.
+type Version struct {
+	Name   string            `json:"name"`
+	Tags   []string          `json:"tags,omitempty"`
+	Meta   map[string]string `json:"meta,omitempty"`
+	Weight int               `json:"weight"`
+}
+
+func (v *Version) matches(inst registry.Instance) bool {
+	if !inst.HasTags(v.Tags) {
+		return false
+	}
+	for k, want := range v.Meta {
+		if inst.Meta[k] != want {
+			return false
+		}
+	}
+	return true
+}
+
+// Instances returns the instances belonging to the version.
+func (v *Version) Instances(instances []registry.Instance) []registry.Instance {
+	res := instances[:0:0]
+	for _, inst := range instances {
+		if v.matches(inst) {
+			res = append(res, inst)
+		}
+	}
+	return res
+}
+
+// Split divides a route's traffic between versions by weight. A request
+// naming a version in Header or Cookie is sent to it whatever its weight,
+// so a weight of 0 only serves forced requests. With Sticky, a balancer key
+// source like "claim:name", the same user always lands on the same version
+// as long as the weights don't change.
+type Split struct {
+	Versions []*Version `json:"versions"`
+	Header   string     `json:"header,omitempty"`
+	Cookie   string     `json:"cookie,omitempty"`
+	Sticky   string     `json:"sticky,omitempty"`
+
+	sticky balancer.KeySource
+	total  int
+}
+
+func (s *Split) compile() error {
+	if len(s.Versions) == 0 {
+		return ErrNoVersions
+	}
+	names := make(map[string]bool)
+	s.total = 0
+	for _, v := range s.Versions {
+		if v.Name == "" || names[v.Name] {
+			return fmt.Errorf("%v: %q", ErrVersionName, v.Name)
+		}
+		names[v.Name] = true
+		if v.Weight > 0 {
+			s.total += v.Weight
+		}
+	}
+	if s.total == 0 {
+		return ErrNoSplitWeight
+	}
+	sticky, err := balancer.ParseKeySource(s.Sticky)
+	if err != nil {
+		return err
+	}
+	s.sticky = sticky
+	return nil
+}
+
+// Choose picks the version serving req.
+func (s *Split) Choose(req *http.Request) *Version {
+	if s.Header != "" {
+		if v := s.version(req.Header.Get(s.Header)); v != nil {
+			return v
+		}
+	}
+	if s.Cookie != "" {
+		if c, err := req.Cookie(s.Cookie); err == nil {
+			if v := s.version(c.Value); v != nil {
+				return v
+			}
+		}
+	}
+
+	var n int
+	if key := s.sticky.Key(req); key != "" {
+		n = int(crc32.ChecksumIEEE([]byte(key)) % uint32(s.total))
+	} else {
+		n = rand.Intn(s.total)
+	}
+	for _, v := range s.Versions {
+		if v.Weight <= 0 {
+			continue
+		}
+		if n < v.Weight {
+			return v
+		}
+		n -= v.Weight
+	}
+	return s.Versions[len(s.Versions)-1]
+}
+
+func (s *Split) version(name string) *Version {
+	if name == "" {
+		return nil
+	}
+	for _, v := range s.Versions {
+		if v.Name == name {
+			return v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package route
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	DefaultStreamIdle     = 5 * time.Minute
+	DefaultStreamLifetime = time.Hour
+)
+
+var (
+	ErrStreamConnections = errors.New("stream max_connections can't be negative")
+	ErrStreamDuration    = errors.New("stream idle and lifetime must be positive")
+	ErrStreamIdle        = errors.New("stream idle must be at least 1s")
+)
+
+// minStreamIdle keeps the idle checks, a few per idle period, affordable.
+const minStreamIdle = time.Second
+
+var defaultStream = &Stream{idle: DefaultStreamIdle, lifetime: DefaultStreamLifetime}
+
+// Stream limits the WebSocket and Server-Sent Events connections of a
+// route, which the gateway proxies without the route timeout. A connection
+// is closed after Idle without data in either direction, and after Lifetime
+// in any case. MaxConnections bounds the open connections of the route, 0
+// means no bound.
+type Stream struct {
+	Idle           string `json:"idle,omitempty"`
+	Lifetime       string `json:"lifetime,omitempty"`
+	MaxConnections int    `json:"max_connections,omitempty"`
+
+	idle     time.Duration
+	lifetime time.Duration
+}
+
+func (s *Stream) compile() error {
+	s.idle, s.lifetime = DefaultStreamIdle, DefaultStreamLifetime
+	if s.Idle != "" {
+		idle, err := time.ParseDuration(s.Idle)
+		if err != nil {
+			return err
+		}
+		s.idle = idle
+	}
+	if s.Lifetime != "" {
+		lifetime, err := time.ParseDuration(s.Lifetime)
+		if err != nil {
+			return err
+		}
+		s.lifetime = lifetime
+	}
+	if s.idle <= 0 || s.lifetime <= 0 {
+		return ErrStreamDuration
+	}
+	if s.idle < minStreamIdle {
+		return ErrStreamIdle
+	}
+	if s.MaxConnections < 0 {
+		return ErrStreamConnections
+	}
+	return nil
+}
+
+func (s *Stream) IdleDuration() time.Duration {
+	return s.idle
+}
+
+func (s *Stream) LifetimeDuration() time.Duration {
+	return s.lifetime
+}
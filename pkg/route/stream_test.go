@@ -0,0 +1,39 @@
+package route
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestStreamLimits(t *testing.T) {
+	for _, tc := range []struct {
+		stream string
+		idle   time.Duration
+		err    bool
+	}{
+		{`{}`, DefaultStreamIdle, false},
+		{`{"idle": "1s"}`, time.Second, false},
+		{`{"idle": "30s", "lifetime": "10m"}`, 30 * time.Second, false},
+		{`{"idle": "3ns"}`, 0, true},
+		{`{"idle": "999ms"}`, 0, true},
+		{`{"idle": "0s"}`, 0, true},
+		{`{"lifetime": "-1m"}`, 0, true},
+		{`{"max_connections": -1}`, 0, true},
+	} {
+		table, err := Parse([]byte(fmt.Sprintf(`{"routes": [{"path_prefix": "/live/", "service": "biz", "stream": %s}]}`, tc.stream)))
+		if tc.err {
+			if err == nil {
+				t.Errorf("stream %s: no error", tc.stream)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("stream %s: %v", tc.stream, err)
+			continue
+		}
+		if got := table.Routes[0].StreamLimits().IdleDuration(); got != tc.idle {
+			t.Errorf("stream %s: idle %v, want %v", tc.stream, got, tc.idle)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package tlsconfig
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrIdentity = errors.New("certificate is not issued to the service")
+
+// VerifyIdentity checks cert is issued to the Consul service: a DNS name
+// equal to service or under service.service., as the Consul DNS interface
+// names it, or a SPIFFE URI ending in /svc/service as Consul Connect issues.
+func VerifyIdentity(cert *x509.Certificate, service string) error {
+	service = strings.ToLower(service)
+	for _, name := range cert.DNSNames {
+		name = strings.ToLower(name)
+		if name == service || strings.HasPrefix(name, service+".service.") {
+			return nil
+		}
+	}
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" && strings.HasSuffix(uri.Path, "/svc/"+service) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%v %q: dns names %v, uris %v", ErrIdentity, service, cert.DNSNames, cert.URIs)
+}